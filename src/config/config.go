@@ -10,9 +10,9 @@ import (
 
 const (
 	// 默认端口
-	DefaultPort     = "8080"
-	LocalStorageDir = "./uploads"
-	DbName          = "FileMeta.db"
+	DefaultPort  = "8080"
+	UploadTmpDir = "./tmp" // 分块上传的临时目录, 每个任务一个子目录
+	DbName       = "FileMeta.db"
 )
 
 // 默认写默认json配置到目标路径
@@ -36,7 +36,7 @@ func main() {
 	cfg.Print("")
 
 	engine := gin.Default()
-	err = router.RegisterAll(engine, cfg.Storage)
+	err = router.RegisterAll(engine, cfg)
 	if err != nil {
 		log.Fatalln(err)
 	}
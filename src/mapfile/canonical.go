@@ -0,0 +1,98 @@
+package mapfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// IsoMapPack5 里每个格子 11 字节: x, y (uint16), 地块号 (int32), 子地块, 高度, 冰
+const isoCellSize = 11
+
+// 编辑器自己写的校验, 每次保存都会变, 不参与规范化
+var ignoredSections = []string{"digest"}
+
+// 压缩的节按解压后的内容参与哈希, 不同编辑器的压缩和base64换行方式不影响结果
+var packSections = map[string]func([]byte) ([]byte, error){
+	"isomappack5":     normalizeIsoMapPack,
+	"previewpack":     DecompressLZOPack,
+	"overlaypack":     DecompressFormat80Pack,
+	"overlaydatapack": DecompressFormat80Pack,
+}
+
+// 规范化之后的sha256: 节名和键名转小写后排序, 去掉 [Digest], 压缩的节换成解压后内容的哈希.
+// 只是换行符, 节的顺序, 注释或者 [Digest] 不同的地图得到同样的结果
+func CanonicalHash(ini *INI) string {
+	type entry struct {
+		key   string
+		value string
+	}
+	sections := make(map[string][]entry)
+	for _, section := range ini.Sections() {
+		name := strings.ToLower(section.Name)
+		if slices.Contains(ignoredSections, name) {
+			continue
+		}
+		if decode, ok := packSections[name]; ok {
+			sections[name] = []entry{{"", packDigest(section, decode)}}
+			continue
+		}
+		entries := make([]entry, 0, len(section.Keys()))
+		for _, key := range section.Keys() {
+			value, _ := section.Get(key)
+			entries = append(entries, entry{strings.ToLower(key), value})
+		}
+		slices.SortFunc(entries, func(a, b entry) int { return strings.Compare(a.key, b.key) })
+		sections[name] = entries
+	}
+
+	hasher := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(sections)) {
+		hasher.Write([]byte("[" + name + "]\n"))
+		for _, e := range sections[name] {
+			hasher.Write([]byte(e.key + "=" + e.value + "\n"))
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func packDigest(section *Section, decode func([]byte) ([]byte, error)) string {
+	sum := sha256.Sum256(packContent(section, decode))
+	return hex.EncodeToString(sum[:])
+}
+
+// 压缩的节解压后的内容, 解压失败就退回到拼起来的原始base64
+func packContent(section *Section, decode func([]byte) ([]byte, error)) []byte {
+	data, err := DecodePackSection(section)
+	if err == nil {
+		if decoded, err := decode(data); err == nil {
+			return decoded
+		}
+	}
+	var builder strings.Builder
+	for _, key := range section.Keys() {
+		value, _ := section.Get(key)
+		builder.WriteString(value)
+	}
+	return []byte(builder.String())
+}
+
+// 地块的顺序由编辑器决定, 每个地块按字节排序之后再比较
+func normalizeIsoMapPack(data []byte) ([]byte, error) {
+	cells, err := DecompressLZOPack(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(cells)%isoCellSize != 0 {
+		return cells, nil
+	}
+	records := make([][]byte, 0, len(cells)/isoCellSize)
+	for i := 0; i < len(cells); i += isoCellSize {
+		records = append(records, cells[i:i+isoCellSize])
+	}
+	slices.SortFunc(records, bytes.Compare)
+	return bytes.Join(records, nil), nil
+}
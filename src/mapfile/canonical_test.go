@@ -0,0 +1,87 @@
+package mapfile
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// 节名键名小写排序后按 "[节]\n键=值\n" 拼起来的sha256
+func TestCanonicalHashVector(t *testing.T) {
+	ini := mustParseINI(t, "[Map]\nSize=0,0,50,50\n[Basic]\nName=x\nAuthor=b\n")
+	want := "04e215cf07c321cbf7d8a1b470558797552df20cef81983c5674b79a473e64db"
+	if got := CanonicalHash(ini); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// 测试用的地块: 每个格子 11 字节
+func testIsoCells(count int) []byte {
+	var cells []byte
+	for i := range count {
+		cells = binary.LittleEndian.AppendUint16(cells, uint16(i%10))
+		cells = binary.LittleEndian.AppendUint16(cells, uint16(i/10))
+		cells = binary.LittleEndian.AppendUint32(cells, uint32(i%7))
+		cells = append(cells, 0, byte(i%3), 0)
+	}
+	return cells
+}
+
+// 同样的地块换一种写法: 格子倒序, base64 每行76个字符
+func reorderedIsoPack(cells []byte) string {
+	var reversed []byte
+	for i := len(cells) - isoCellSize; i >= 0; i -= isoCellSize {
+		reversed = append(reversed, cells[i:i+isoCellSize]...)
+	}
+	encoded := base64.StdEncoding.EncodeToString(lzoPack(reversed))
+	var builder strings.Builder
+	builder.WriteString("[IsoMapPack5]\r\n")
+	for i := 0; len(encoded) > 0; i++ {
+		n := min(len(encoded), 76)
+		fmt.Fprintf(&builder, "%d=%s\r\n", i+1, encoded[:n])
+		encoded = encoded[n:]
+	}
+	return builder.String()
+}
+
+func TestCanonicalHashEquivalent(t *testing.T) {
+	cells := testIsoCells(40)
+	base := "[Basic]\nName=x\nAuthor=b\n[Map]\nSize=0,0,50,50\n[Digest]\n1=abc\n" +
+		packSectionText("IsoMapPack5", lzoPack(cells))
+	// 换行符, 节顺序, 键名大小写, 注释, Digest 和地块的写法都不一样
+	equivalent := "; saved by another editor\r\n" + reorderedIsoPack(cells) +
+		"[map]\r\nsize=0,0,50,50\r\n[BASIC]\r\nauthor=b ; who\r\nNAME=x\r\n[Digest]\r\n1=def\r\n"
+
+	want := CanonicalHash(mustParseINI(t, base))
+	if got := CanonicalHash(mustParseINI(t, equivalent)); got != want {
+		t.Errorf("equivalent map hash differs")
+	}
+
+	changed := strings.Replace(base, "Author=b", "Author=c", 1)
+	if CanonicalHash(mustParseINI(t, changed)) == want {
+		t.Error("changed value should change the hash")
+	}
+	cells[4] = 9
+	changed = "[Basic]\nName=x\nAuthor=b\n[Map]\nSize=0,0,50,50\n" + packSectionText("IsoMapPack5", lzoPack(cells))
+	if CanonicalHash(mustParseINI(t, changed)) == want {
+		t.Error("changed tile should change the hash")
+	}
+}
+
+// 解不开的压缩节按原始文本参与哈希, 不能 panic
+func TestCanonicalHashCorruptPack(t *testing.T) {
+	corrupt := func(data []byte) string {
+		return CanonicalHash(mustParseINI(t, "[Map]\nSize=0,0,1,1\n"+packSectionText("OverlayPack", data)))
+	}
+	a := corrupt([]byte{0xff, 0xff, 1, 2, 3})
+	if a != corrupt([]byte{0xff, 0xff, 1, 2, 3}) {
+		t.Error("same corrupt pack should hash the same")
+	}
+	if a == corrupt([]byte{0xff, 0xff, 1, 2, 4}) {
+		t.Error("different corrupt pack should hash differently")
+	}
+	CanonicalHash(mustParseINI(t, "[IsoMapPack5]\n1=!!\n[PreviewPack]\n1="+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0}, 9))+"\n"))
+}
@@ -0,0 +1,115 @@
+package mapfile
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type Game string
+
+const (
+	GameRA2 Game = "ra2"
+	GameYR  Game = "yr"
+)
+
+// 只有尤里的复仇里才有的地形
+var yrTheaters = []string{"DESERT", "NEWURBAN", "LUNAR"}
+
+// 只有尤里的复仇里才有的步兵和载具, 尤里阵营的建筑统一是 YA 开头, 单独判断
+var yrOnlyTypes = map[string]bool{
+	"INIT": true, "BRUTE": true, "VIRUS": true, "YENGINEER": true, "SLAV": true, "GGI": true, "LUNR": true,
+	"YTNK": true, "TELE": true, "CAOS": true, "SMIN": true, "PCV": true, "BFRT": true, "ROBO": true,
+	"SCHP": true, "MIND": true, "BSUB": true, "YHVR": true, "DISK": true,
+}
+
+// 放置单位的节, 值是 "所属方,类型,..."
+var objectSections = []string{"Infantry", "Units", "Aircraft", "Structures"}
+
+// 地图类型, 决定存储时用的扩展名
+type MapType struct {
+	Game        Game `json:"game"`
+	Multiplayer bool `json:"multiplayer"`
+}
+
+// 游戏能识别的扩展名, 第一个是联机地图默认用的
+func (g Game) Exts() []string {
+	if g == GameYR {
+		return []string{".yrm", ".yro", ".map"}
+	}
+	return []string{".mpr", ".map"}
+}
+
+// 扩展名是不是随便哪个游戏能识别的地图
+func HasMapExt(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return slices.Contains(GameRA2.Exts(), ext) || slices.Contains(GameYR.Exts(), ext)
+}
+
+// 默认扩展名: 联机地图 .mpr/.yrm, 任务地图 .map
+func (t MapType) Ext() string {
+	if !t.Multiplayer {
+		return ".map"
+	}
+	return t.Game.Exts()[0]
+}
+
+// 识别地图类型, 至少要有 [Basic] 和合法的 [Map], 否则返回 ErrNotMap.
+// 用到尤里的复仇独有的地形, 单位, 阵营或者 RequiredAddOn 就是尤里的复仇地图;
+// MultiplayerOnly 或者有 GameMode 的是联机地图
+func Detect(ini *INI) (MapType, error) {
+	basic := ini.Section("Basic")
+	if basic == nil {
+		return MapType{}, fmt.Errorf("%w : missing [Basic]", ErrNotMap)
+	}
+	if _, err := ReadInfo(ini); err != nil {
+		return MapType{}, err
+	}
+
+	t := MapType{Game: GameRA2}
+	if isYR(ini) {
+		t.Game = GameYR
+	}
+	t.Multiplayer = basic.Bool("MultiplayerOnly", false) || basic.String("GameMode", "") != ""
+	return t, nil
+}
+
+func isYR(ini *INI) bool {
+	if ini.Section("Basic").Int("RequiredAddOn", 0) == 1 {
+		return true
+	}
+	if slices.Contains(yrTheaters, strings.ToUpper(ini.Section("Map").String("Theater", ""))) {
+		return true
+	}
+	if ini.Section("YuriCountry") != nil {
+		return true
+	}
+	for _, name := range objectSections {
+		section := ini.Section(name)
+		for _, key := range section.Keys() {
+			value, _ := section.Get(key)
+			fields := strings.Split(value, ",")
+			if len(fields) < 2 {
+				continue
+			}
+			objectType := strings.ToUpper(strings.TrimSpace(fields[1]))
+			if yrOnlyTypes[objectType] || (name == "Structures" && strings.HasPrefix(objectType, "YA")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// name 的扩展名游戏 g 认得就保留, 是别的地图扩展名就换成 ext, 没有地图扩展名就加上 ext
+func WithExt(name string, g Game, ext string) string {
+	current := strings.ToLower(filepath.Ext(name))
+	if slices.Contains(g.Exts(), current) {
+		return name
+	}
+	if HasMapExt(name) {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name + ext
+}
@@ -0,0 +1,83 @@
+package mapfile
+
+import (
+	"errors"
+	"testing"
+)
+
+const testMapBody = "[Map]\nSize=0,0,50,50\nTheater=TEMPERATE\n"
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		name string
+		text string
+		want MapType
+	}{
+		{"ra2 mission", "[Basic]\nName=m\n" + testMapBody, MapType{GameRA2, false}},
+		{"ra2 multiplayer", "[Basic]\nMultiplayerOnly=yes\n" + testMapBody, MapType{GameRA2, true}},
+		{"game mode", "[Basic]\nGameMode=standard\n" + testMapBody, MapType{GameRA2, true}},
+		{"required addon", "[Basic]\nRequiredAddOn=1\nMultiplayerOnly=1\n" + testMapBody, MapType{GameYR, true}},
+		{"yr theater", "[Basic]\n[Map]\nSize=0,0,50,50\nTheater=lunar\n", MapType{GameYR, false}},
+		{"yuri country", "[Basic]\n[YuriCountry]\nName=x\n" + testMapBody, MapType{GameYR, false}},
+		{"yr unit", "[Basic]\n[Units]\n0=Americans,ytnk,256,50,50,64,Guard,0,-1,0,-1,0,1,0,0\n" + testMapBody, MapType{GameYR, false}},
+		{"yuri building", "[Basic]\n[Structures]\n0=YuriCountry,YAPOWR,256,30,30,0,None,0,0,1,0,0,None,None,None,0,0\n" + testMapBody, MapType{GameYR, false}},
+		// 别的节里的尤里单位名不算
+		{"unit name elsewhere", "[Basic]\n[Tags]\n0=0,YTNK,01000000\n" + testMapBody, MapType{GameRA2, false}},
+	}
+	for _, c := range cases {
+		got, err := Detect(mustParseINI(t, c.text))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDetectNotMap(t *testing.T) {
+	for _, text := range []string{"", testMapBody, "[Basic]\nName=x\n", "[Basic]\n[Map]\nSize=1,2\n"} {
+		if _, err := Detect(mustParseINI(t, text)); !errors.Is(err, ErrNotMap) {
+			t.Errorf("Detect(%q) = %v, want ErrNotMap", text, err)
+		}
+	}
+}
+
+func TestMapTypeExt(t *testing.T) {
+	for _, c := range []struct {
+		t    MapType
+		want string
+	}{
+		{MapType{GameRA2, true}, ".mpr"},
+		{MapType{GameYR, true}, ".yrm"},
+		{MapType{GameYR, false}, ".map"},
+	} {
+		if got := c.t.Ext(); got != c.want {
+			t.Errorf("%+v: got %s, want %s", c.t, got, c.want)
+		}
+	}
+}
+
+func TestWithExt(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		game Game
+		ext  string
+		want string
+	}{
+		{"a.map", GameRA2, ".mpr", "a.map"},
+		{"a.yro", GameYR, ".yrm", "a.yro"},
+		{"a.yrm", GameRA2, ".mpr", "a.mpr"},
+		{"a.MPR", GameYR, ".yrm", "a.yrm"},
+		{"a", GameYR, ".yrm", "a.yrm"},
+		{"a.txt", GameRA2, ".map", "a.txt.map"},
+	} {
+		if got := WithExt(c.name, c.game, c.ext); got != c.want {
+			t.Errorf("WithExt(%q, %s, %s) = %q, want %q", c.name, c.game, c.ext, got, c.want)
+		}
+	}
+	if !HasMapExt("x.YRO") || HasMapExt("x.ini") {
+		t.Error("HasMapExt")
+	}
+}
@@ -0,0 +1,128 @@
+package mapfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type DiffStatus string
+
+const (
+	DiffAdded     DiffStatus = "added"
+	DiffRemoved   DiffStatus = "removed"
+	DiffChanged   DiffStatus = "changed"
+	DiffUnchanged DiffStatus = "unchanged" // 只有压缩的节会出现
+)
+
+type KeyChange struct {
+	Key string `json:"key"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// 压缩的节不比较具体内容, 只给出解压后的大小
+type PackSummary struct {
+	OldSize int `json:"old_size"`
+	NewSize int `json:"new_size"`
+}
+
+type SectionDiff struct {
+	Name    string       `json:"name"`
+	Status  DiffStatus   `json:"status"`
+	Added   []KeyChange  `json:"added,omitempty"`
+	Removed []KeyChange  `json:"removed,omitempty"`
+	Changed []KeyChange  `json:"changed,omitempty"`
+	Pack    *PackSummary `json:"pack,omitempty"`
+}
+
+// 节级别的差异: 普通的节只列出有变化的, 压缩的节无论变没变都会列出来
+func Diff(from *INI, to *INI) []SectionDiff {
+	var result []SectionDiff
+	for _, section := range to.Sections() {
+		if diff, ok := diffSection(from.Section(section.Name), section, section.Name); ok {
+			result = append(result, diff)
+		}
+	}
+	for _, section := range from.Sections() {
+		if to.Section(section.Name) == nil {
+			diff, _ := diffSection(section, nil, section.Name)
+			result = append(result, diff)
+		}
+	}
+	return result
+}
+
+// old 或 new 为 nil 表示整个节被删掉或者是新加的
+func diffSection(old *Section, new *Section, name string) (SectionDiff, bool) {
+	diff := SectionDiff{Name: name, Status: DiffChanged}
+	switch {
+	case old == nil:
+		diff.Status = DiffAdded
+	case new == nil:
+		diff.Status = DiffRemoved
+	}
+
+	if decode, ok := packSections[strings.ToLower(name)]; ok {
+		var oldData, newData []byte
+		if old != nil {
+			oldData = packContent(old, decode)
+		}
+		if new != nil {
+			newData = packContent(new, decode)
+		}
+		diff.Pack = &PackSummary{OldSize: len(oldData), NewSize: len(newData)}
+		if old != nil && new != nil && bytes.Equal(oldData, newData) {
+			diff.Status = DiffUnchanged
+		}
+		return diff, true
+	}
+
+	for _, key := range new.Keys() {
+		value, _ := new.Get(key)
+		oldValue, ok := old.Get(key)
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, KeyChange{Key: key, New: value})
+		case oldValue != value:
+			diff.Changed = append(diff.Changed, KeyChange{Key: key, Old: oldValue, New: value})
+		}
+	}
+	for _, key := range old.Keys() {
+		if _, ok := new.Get(key); !ok {
+			value, _ := old.Get(key)
+			diff.Removed = append(diff.Removed, KeyChange{Key: key, Old: value})
+		}
+	}
+	changed := len(diff.Added)+len(diff.Removed)+len(diff.Changed) > 0
+	return diff, changed || diff.Status != DiffChanged
+}
+
+// 输出成统一diff格式, 每个节一个 hunk, 压缩的节只写一行摘要
+func WriteUnified(w io.Writer, fromName string, toName string, diffs []SectionDiff) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- a/%s\n+++ b/%s\n", fromName, toName)
+	for _, diff := range diffs {
+		if diff.Pack != nil {
+			fmt.Fprintf(&buf, "@@ [%s] binary %s, %d -> %d bytes @@\n", diff.Name, diff.Status, diff.Pack.OldSize, diff.Pack.NewSize)
+			continue
+		}
+		if diff.Status == DiffChanged {
+			fmt.Fprintf(&buf, "@@ [%s] @@\n", diff.Name)
+		} else {
+			fmt.Fprintf(&buf, "@@ [%s] %s @@\n", diff.Name, diff.Status)
+		}
+		for _, change := range diff.Removed {
+			fmt.Fprintf(&buf, "-%s=%s\n", change.Key, change.Old)
+		}
+		for _, change := range diff.Changed {
+			fmt.Fprintf(&buf, "-%s=%s\n+%s=%s\n", change.Key, change.Old, change.Key, change.New)
+		}
+		for _, change := range diff.Added {
+			fmt.Fprintf(&buf, "+%s=%s\n", change.Key, change.New)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,70 @@
+package mapfile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	cells := testIsoCells(20)
+	from := mustParseINI(t, "[Basic]\nName=old\nAuthor=a\nPercent=0\n[Map]\nSize=0,0,50,50\n[Tags]\n0=x\n"+
+		packSectionText("IsoMapPack5", lzoPack(cells)))
+	to := mustParseINI(t, "[basic]\nname=new\nAuthor=a\nOfficial=no\n[Map]\nSize=0,0,50,50\n[Triggers]\n0=y\n"+
+		reorderedIsoPack(cells)+packSectionText("OverlayPack", format80Pack(make([]byte, 100))))
+
+	diffs := Diff(from, to)
+	byName := make(map[string]SectionDiff)
+	for _, diff := range diffs {
+		byName[diff.Name] = diff
+	}
+	if len(diffs) != 5 {
+		t.Fatalf("got %d sections: %+v", len(diffs), diffs)
+	}
+	if _, ok := byName["Map"]; ok {
+		t.Error("unchanged section should not be listed")
+	}
+
+	basic := byName["basic"]
+	if basic.Status != DiffChanged ||
+		len(basic.Changed) != 1 || basic.Changed[0] != (KeyChange{Key: "name", Old: "old", New: "new"}) ||
+		len(basic.Added) != 1 || basic.Added[0].Key != "Official" ||
+		len(basic.Removed) != 1 || basic.Removed[0].Key != "Percent" {
+		t.Errorf("basic = %+v", basic)
+	}
+	if byName["Triggers"].Status != DiffAdded || byName["Tags"].Status != DiffRemoved {
+		t.Errorf("triggers = %+v, tags = %+v", byName["Triggers"], byName["Tags"])
+	}
+	// 压缩的节按解压后的内容比较, 地块顺序不同也算没变
+	iso := byName["IsoMapPack5"]
+	if iso.Status != DiffUnchanged || iso.Pack == nil || iso.Pack.OldSize != len(cells) || iso.Pack.NewSize != len(cells) {
+		t.Errorf("iso = %+v %+v", iso, iso.Pack)
+	}
+	overlay := byName["OverlayPack"]
+	if overlay.Status != DiffAdded || overlay.Pack.OldSize != 0 || overlay.Pack.NewSize != 100 {
+		t.Errorf("overlay = %+v %+v", overlay, overlay.Pack)
+	}
+}
+
+func TestWriteUnified(t *testing.T) {
+	from := mustParseINI(t, "[Basic]\nName=old\nPercent=0\n[Tags]\n0=x\n")
+	to := mustParseINI(t, "[Basic]\nName=new\nOfficial=no\n"+packSectionText("PreviewPack", lzoPack([]byte("abc"))))
+
+	var buf bytes.Buffer
+	if err := WriteUnified(&buf, "a.map", "b.map", Diff(from, to)); err != nil {
+		t.Fatal(err)
+	}
+	want := `--- a/a.map
++++ b/b.map
+@@ [Basic] @@
+-Percent=0
+-Name=old
++Name=new
++Official=no
+@@ [PreviewPack] binary added, 0 -> 3 bytes @@
+@@ [Tags] removed @@
+-0=x
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
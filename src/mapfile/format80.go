@@ -0,0 +1,103 @@
+package mapfile
+
+import (
+	"errors"
+)
+
+var ErrCorruptFormat80 = errors.New("corrupt format80 data")
+
+// 西木头的 Format80 (LCW) 解压, 地图里的 OverlayPack 和 OverlayDataPack 用它压缩
+func DecompressFormat80(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	ip := 0
+	next := func() (int, error) {
+		if ip >= len(in) {
+			return 0, ErrCorruptFormat80
+		}
+		b := in[ip]
+		ip++
+		return int(b), nil
+	}
+	le16 := func() (int, error) {
+		if ip+2 > len(in) {
+			return 0, ErrCorruptFormat80
+		}
+		v := int(in[ip]) | int(in[ip+1])<<8
+		ip += 2
+		return v, nil
+	}
+	// 从已解压的 pos 处复制, 源和目标可能重叠
+	copyFrom := func(pos int, count int) error {
+		if pos < 0 || pos >= len(out) || len(out)+count > outLen {
+			return ErrCorruptFormat80
+		}
+		for i := 0; i < count; i++ {
+			out = append(out, out[pos+i])
+		}
+		return nil
+	}
+
+	for {
+		cmd, err := next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case cmd&0x80 == 0: // 0cccpppp pppppppp: 相对位置复制
+			b, err := next()
+			if err != nil {
+				return nil, err
+			}
+			count := (cmd&0x70)>>4 + 3
+			if err := copyFrom(len(out)-((cmd&0x0f)<<8|b), count); err != nil {
+				return nil, err
+			}
+		case cmd&0x40 == 0: // 10cccccc: 字面量, 个数为0是结束标记
+			count := cmd & 0x3f
+			if count == 0 {
+				if len(out) != outLen {
+					return nil, ErrCorruptFormat80
+				}
+				return out, nil
+			}
+			if ip+count > len(in) || len(out)+count > outLen {
+				return nil, ErrCorruptFormat80
+			}
+			out = append(out, in[ip:ip+count]...)
+			ip += count
+		case cmd == 0xfe: // 填充
+			count, err := le16()
+			if err != nil {
+				return nil, err
+			}
+			value, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if len(out)+count > outLen {
+				return nil, ErrCorruptFormat80
+			}
+			for i := 0; i < count; i++ {
+				out = append(out, byte(value))
+			}
+		default: // 11cccccc 或 0xff: 绝对位置复制
+			count := cmd&0x3f + 3
+			if cmd == 0xff {
+				if count, err = le16(); err != nil {
+					return nil, err
+				}
+			}
+			pos, err := le16()
+			if err != nil {
+				return nil, err
+			}
+			if err := copyFrom(pos, count); err != nil {
+				return nil, err
+			}
+		}
+		// 有的编码器不写结束标记, 长度够了就算结束
+		if len(out) == outLen && ip == len(in) {
+			return out, nil
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package mapfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// 按 Format80 的格式手写的流, 每种命令至少一个
+var format80Vectors = []struct {
+	name string
+	in   []byte
+	out  []byte
+}{
+	{
+		"all commands",
+		[]byte{
+			0x83, 'a', 'b', 'c', // 3个字面量
+			0x00, 0x03, // 相对位置复制, 往前3个, 3个字节
+			0xfe, 0x04, 0x00, 'z', // 填充4个 z
+			0xc1, 0x01, 0x00, // 绝对位置1复制4个字节
+			0xff, 0x05, 0x00, 0x00, 0x00, // 绝对位置0复制5个字节
+			0x80,
+		},
+		[]byte("abcabczzzzbcababcab"),
+	},
+	// 相对复制和自己重叠, 往前1个复制6个字节
+	{"overlap", []byte{0x81, 'x', 0x30, 0x01, 0x80}, []byte("xxxxxxx")},
+	// 没有结束标记, 长度够了就结束
+	{"no end marker", []byte{0x83, 'a', 'b', 'c'}, []byte("abc")},
+}
+
+func TestDecompressFormat80(t *testing.T) {
+	for _, v := range format80Vectors {
+		got, err := DecompressFormat80(v.in, len(v.out))
+		if err != nil {
+			t.Errorf("%s: %v", v.name, err)
+			continue
+		}
+		if !bytes.Equal(got, v.out) {
+			t.Errorf("%s: got %q, want %q", v.name, got, v.out)
+		}
+		// 截断到结束标记之前都要报错
+		end := len(v.in)
+		if v.in[end-1] == 0x80 {
+			end--
+		}
+		for i := range end {
+			if _, err := DecompressFormat80(v.in[:i], len(v.out)); !errors.Is(err, ErrCorruptFormat80) {
+				t.Errorf("%s truncated to %d: err = %v", v.name, i, err)
+			}
+		}
+		if _, err := DecompressFormat80(v.in, len(v.out)+1); !errors.Is(err, ErrCorruptFormat80) {
+			t.Errorf("%s longer outLen: err = %v", v.name, err)
+		}
+	}
+}
+
+func TestDecompressFormat80Malformed(t *testing.T) {
+	for name, in := range map[string][]byte{
+		"relative before start": {0x83, 'a', 'b', 'c', 0x00, 0x05, 0x80},
+		"absolute past output":  {0x83, 'a', 'b', 'c', 0xc0, 0x03, 0x00, 0x80},
+		"fill past outLen":      {0xfe, 0xff, 0xff, 'z', 0x80},
+		"literals past input":   {0x8a, 'a'},
+		"early end marker":      {0x81, 'a', 0x80},
+		"long copy past outLen": {0x81, 'a', 0xff, 0xff, 0x00, 0x00, 0x00, 0x80},
+	} {
+		if _, err := DecompressFormat80(in, 8); !errors.Is(err, ErrCorruptFormat80) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+	// 随机输入不能 panic
+	rng := rand.New(rand.NewSource(1))
+	for range 5000 {
+		in := make([]byte, rng.Intn(64))
+		rng.Read(in)
+		DecompressFormat80(in, rng.Intn(4096))
+	}
+}
+
+// 连续相同的字节用填充, 其余用字面量, 用来造 OverlayPack 这类测试数据
+func format80Encode(data []byte) []byte {
+	var out []byte
+	for len(data) > 0 {
+		run := 1
+		for run < len(data) && run < 0xffff && data[run] == data[0] {
+			run++
+		}
+		if run >= 3 {
+			out = append(out, 0xfe)
+			out = binary.LittleEndian.AppendUint16(out, uint16(run))
+			out = append(out, data[0])
+			data = data[run:]
+			continue
+		}
+		n := min(len(data), 63)
+		out = append(out, 0x80|byte(n))
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return append(out, 0x80)
+}
+
+// 按 8192 字节分块, 和游戏写 OverlayPack 的方式一样
+func format80Pack(data []byte) []byte {
+	var out []byte
+	for len(data) > 0 {
+		n := min(len(data), 8192)
+		chunk := format80Encode(data[:n])
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(chunk)))
+		out = binary.LittleEndian.AppendUint16(out, uint16(n))
+		out = append(out, chunk...)
+		data = data[n:]
+	}
+	return out
+}
+
+func TestDecompressFormat80Pack(t *testing.T) {
+	data := make([]byte, 20000)
+	for i := range data {
+		if i%97 < 5 {
+			data[i] = byte(i)
+		}
+	}
+	got, err := DecompressFormat80Pack(format80Pack(data))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("round trip failed: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package mapfile
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// 地图里单行最长的一般是触发和脚本, 留足余量
+const maxLineLength = 1 << 20
+
+// 西木头的ini格式, [Section] 加 key=value, ';' 之后是注释.
+// 节名和键名大小写不敏感, 同一节里重复的键后出现的覆盖先出现的, 顺序按第一次出现的位置
+type INI struct {
+	sections map[string]*Section
+	order    []*Section
+}
+
+type Section struct {
+	Name   string
+	keys   []string
+	values map[string]string // 小写key -> value
+}
+
+// 解析ini, 不是utf-8的行按GB18030解码(国内的地图编辑器大多存成GBK)
+func ParseINI(r io.Reader) (*INI, error) {
+	ini := &INI{sections: make(map[string]*Section)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxLineLength)
+
+	var current *Section
+	first := true
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if first {
+			line = bytes.TrimPrefix(line, []byte("\xef\xbb\xbf"))
+			first = false
+		}
+		text := DecodeText(line)
+		if i := strings.IndexByte(text, ';'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		if text[0] == '[' {
+			end := strings.IndexByte(text, ']')
+			if end < 0 {
+				continue
+			}
+			current = ini.addSection(strings.TrimSpace(text[1:end]))
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			continue
+		}
+		current.set(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ini, nil
+}
+
+// 不是utf-8的文本按GB18030解码, 解码失败原样返回
+func DecodeText(line []byte) string {
+	if utf8.Valid(line) {
+		return string(line)
+	}
+	decoded, err := simplifiedchinese.GB18030.NewDecoder().Bytes(line)
+	if err != nil {
+		return string(line)
+	}
+	return string(decoded)
+}
+
+// 同名的节合并到一起
+func (f *INI) addSection(name string) *Section {
+	lower := strings.ToLower(name)
+	if section, ok := f.sections[lower]; ok {
+		return section
+	}
+	section := &Section{Name: name, values: make(map[string]string)}
+	f.sections[lower] = section
+	f.order = append(f.order, section)
+	return section
+}
+
+// 不存在时返回nil, Section 的方法都可以在nil上调用
+func (f *INI) Section(name string) *Section {
+	return f.sections[strings.ToLower(name)]
+}
+
+// 按文件里出现的顺序
+func (f *INI) Sections() []*Section {
+	return f.order
+}
+
+func (s *Section) set(key string, value string) {
+	lower := strings.ToLower(key)
+	if _, ok := s.values[lower]; !ok {
+		s.keys = append(s.keys, key)
+	}
+	s.values[lower] = value
+}
+
+// 按文件里出现的顺序
+func (s *Section) Keys() []string {
+	if s == nil {
+		return nil
+	}
+	return s.keys
+}
+
+func (s *Section) Get(key string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	value, ok := s.values[strings.ToLower(key)]
+	return value, ok
+}
+
+func (s *Section) String(key string, def string) string {
+	if value, ok := s.Get(key); ok && value != "" {
+		return value
+	}
+	return def
+}
+
+func (s *Section) Int(key string, def int) int {
+	value, ok := s.Get(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// 西木头的布尔值只看第一个字符, y/t/1 是真
+func (s *Section) Bool(key string, def bool) bool {
+	value, ok := s.Get(key)
+	if !ok || value == "" {
+		return def
+	}
+	switch value[0] {
+	case 'y', 'Y', 't', 'T', '1':
+		return true
+	case 'n', 'N', 'f', 'F', '0':
+		return false
+	}
+	return def
+}
@@ -0,0 +1,141 @@
+package mapfile
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func mustParseINI(t *testing.T, text string) *INI {
+	t.Helper()
+	ini, err := ParseINI(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ini
+}
+
+// 注释, BOM, 大小写, 重复的键和重复的节
+func TestParseINI(t *testing.T) {
+	ini := mustParseINI(t, "\xef\xbb\xbf[Basic]\r\nName = Test Map ; comment\r\n"+
+		"orphan line\r\n; only comment\r\n[basic]\r\nname=Override\r\nAuthor=a\r\n[Broken\r\n[Map]\r\nSize=0,0,50,60\r\n")
+
+	if len(ini.Sections()) != 2 {
+		t.Fatalf("sections = %d, want 2", len(ini.Sections()))
+	}
+	basic := ini.Section("BASIC")
+	if basic.Name != "Basic" {
+		t.Errorf("section name = %q, want first spelling", basic.Name)
+	}
+	if got := basic.String("Name", ""); got != "Override" {
+		t.Errorf("Name = %q, want later value", got)
+	}
+	if got := basic.Keys(); len(got) != 2 || got[0] != "Name" || got[1] != "Author" {
+		t.Errorf("keys = %v", got)
+	}
+	if ini.Section("Missing").String("Name", "def") != "def" {
+		t.Error("nil section should return default")
+	}
+}
+
+func TestParseINIGBK(t *testing.T) {
+	name, err := simplifiedchinese.GB18030.NewEncoder().String("红色警戒")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ini := mustParseINI(t, "[Basic]\nName="+name+"\n")
+	if got := ini.Section("Basic").String("Name", ""); got != "红色警戒" {
+		t.Errorf("Name = %q", got)
+	}
+}
+
+func TestParseINILineTooLong(t *testing.T) {
+	_, err := ParseINI(strings.NewReader("[Basic]\nName=" + strings.Repeat("x", maxLineLength+1)))
+	if err == nil {
+		t.Error("line longer than maxLineLength should fail")
+	}
+}
+
+func TestSectionValues(t *testing.T) {
+	section := mustParseINI(t, "[S]\nyes=Yes\nno=false\nbad=maybe\nn=12\nnan=x\nempty=\n").Section("S")
+	if !section.Bool("yes", false) || section.Bool("no", true) || !section.Bool("bad", true) || !section.Bool("empty", true) {
+		t.Error("Bool")
+	}
+	if section.Int("n", 0) != 12 || section.Int("nan", 7) != 7 || section.Int("missing", 3) != 3 {
+		t.Error("Int")
+	}
+	if section.String("empty", "def") != "def" {
+		t.Error("empty value should use default")
+	}
+}
+
+func TestReadInfo(t *testing.T) {
+	ini := mustParseINI(t, `[Basic]
+Name=Two Rivers
+Author=someone
+GameMode=Standard, meatgrind,standard,
+[Map]
+Size=0,0,100,80
+LocalSize=2,4,96,70
+Theater=SNOW
+[Waypoints]
+0=12034
+1=20050
+3=5005
+8=1000
+x=1
+`)
+	info, err := ReadInfo(ini)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "Two Rivers" || info.Author != "someone" || info.Theater != "SNOW" {
+		t.Errorf("info = %+v", info)
+	}
+	if info.Size != (Rect{0, 0, 100, 80}) || info.LocalSize != (Rect{2, 4, 96, 70}) {
+		t.Errorf("size = %+v local = %+v", info.Size, info.LocalSize)
+	}
+	// 没写人数时按 0-7 号路径点算
+	if info.MaxPlayers != 3 || info.MinPlayers != 2 {
+		t.Errorf("players = %d-%d, want 2-3", info.MinPlayers, info.MaxPlayers)
+	}
+	if info.Waypoints[0] != (Point{X: 34, Y: 12}) || len(info.Waypoints) != 4 {
+		t.Errorf("waypoints = %v", info.Waypoints)
+	}
+	if strings.Join(info.GameModes, ",") != "standard,meatgrind" {
+		t.Errorf("game modes = %v", info.GameModes)
+	}
+	if info.Mission {
+		t.Error("multiplayer map detected as mission")
+	}
+}
+
+func TestReadInfoMission(t *testing.T) {
+	info, err := Parse(strings.NewReader("[Basic]\nPlayer=Americans\nMaxPlayer=0\n[Map]\nSize=0,0,50,50\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mission || info.MaxPlayers != 0 || info.MinPlayers != 0 {
+		t.Errorf("info = %+v", info)
+	}
+	// 缺 LocalSize 时用 Size
+	if info.LocalSize != info.Size {
+		t.Errorf("local size = %+v", info.LocalSize)
+	}
+}
+
+func TestReadInfoNotMap(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"[Basic]\nName=x\n",
+		"[Map]\nSize=0,0,50\n",
+		"[Map]\nSize=a,b,c,d\n",
+		"\x00\x01\x02\xff\xfe",
+	} {
+		if _, err := Parse(strings.NewReader(text)); !errors.Is(err, ErrNotMap) {
+			t.Errorf("Parse(%q) = %v, want ErrNotMap", text, err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package mapfile
+
+import (
+	"errors"
+)
+
+var ErrCorruptLZO = errors.New("corrupt lzo data")
+
+// LZO1X 解压, 地图里的 IsoMapPack5 和 PreviewPack 都用它压缩.
+// outLen 是解压后应有的长度, 越界或者长度对不上都返回 ErrCorruptLZO
+func DecompressLZO(in []byte, outLen int) ([]byte, error) {
+	d := lzoDecoder{in: in, out: make([]byte, 0, outLen), outLen: outLen}
+	if err := d.run(); err != nil {
+		return nil, err
+	}
+	if len(d.out) != outLen {
+		return nil, ErrCorruptLZO
+	}
+	return d.out, nil
+}
+
+type lzoDecoder struct {
+	in     []byte
+	ip     int
+	out    []byte
+	outLen int
+}
+
+func (d *lzoDecoder) byte() (int, error) {
+	if d.ip >= len(d.in) {
+		return 0, ErrCorruptLZO
+	}
+	b := d.in[d.ip]
+	d.ip++
+	return int(b), nil
+}
+
+func (d *lzoDecoder) le16() (int, error) {
+	if d.ip+2 > len(d.in) {
+		return 0, ErrCorruptLZO
+	}
+	v := int(d.in[d.ip]) | int(d.in[d.ip+1])<<8
+	d.ip += 2
+	return v, nil
+}
+
+// 长度为0时后面跟着若干个0字节(每个+255)和一个非0字节
+func (d *lzoDecoder) extLength(base int) (int, error) {
+	n := base
+	for {
+		b, err := d.byte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0 {
+			return n + b, nil
+		}
+		n += 255
+	}
+}
+
+func (d *lzoDecoder) literals(n int) error {
+	if d.ip+n > len(d.in) || len(d.out)+n > d.outLen {
+		return ErrCorruptLZO
+	}
+	d.out = append(d.out, d.in[d.ip:d.ip+n]...)
+	d.ip += n
+	return nil
+}
+
+// 回溯复制, 源和目标可能重叠, 只能逐字节复制
+func (d *lzoDecoder) match(dist int, n int) error {
+	start := len(d.out) - dist
+	if start < 0 || len(d.out)+n > d.outLen {
+		return ErrCorruptLZO
+	}
+	for i := 0; i < n; i++ {
+		d.out = append(d.out, d.out[start+i])
+	}
+	return nil
+}
+
+func (d *lzoDecoder) run() error {
+	// state: 上一个指令之后跟了几个字面量, 4 表示一段长字面量, 决定 t<16 时的含义
+	state := 0
+	if len(d.in) > 0 && d.in[0] > 17 {
+		d.ip++
+		t := int(d.in[0]) - 17
+		if err := d.literals(t); err != nil {
+			return err
+		}
+		state = min(t, 4)
+	}
+
+	for {
+		t, err := d.byte()
+		if err != nil {
+			return err
+		}
+
+		var dist, length, next int
+		switch {
+		case t < 16 && state == 0:
+			length = t
+			if length == 0 {
+				if length, err = d.extLength(15); err != nil {
+					return err
+				}
+			}
+			if err := d.literals(length + 3); err != nil {
+				return err
+			}
+			state = 4
+			continue
+		case t < 16:
+			b, err := d.byte()
+			if err != nil {
+				return err
+			}
+			next = t & 3
+			if state == 4 {
+				dist, length = 1+0x800+t>>2+b<<2, 3
+			} else {
+				dist, length = 1+t>>2+b<<2, 2
+			}
+		case t >= 64:
+			b, err := d.byte()
+			if err != nil {
+				return err
+			}
+			next = t & 3
+			dist, length = 1+(t>>2)&7+b<<3, t>>5+1
+		case t >= 32:
+			length = t & 31
+			if length == 0 {
+				if length, err = d.extLength(31); err != nil {
+					return err
+				}
+			}
+			length += 2
+			v, err := d.le16()
+			if err != nil {
+				return err
+			}
+			dist, next = 1+v>>2, v&3
+		default: // 16 - 31
+			length = t & 7
+			if length == 0 {
+				if length, err = d.extLength(7); err != nil {
+					return err
+				}
+			}
+			length += 2
+			v, err := d.le16()
+			if err != nil {
+				return err
+			}
+			dist, next = (t&8)<<11+v>>2, v&3
+			if dist == 0 { // 结束标记
+				return nil
+			}
+			dist += 0x4000
+		}
+
+		if err := d.match(dist, length); err != nil {
+			return err
+		}
+		if err := d.literals(next); err != nil {
+			return err
+		}
+		state = next
+	}
+}
@@ -0,0 +1,198 @@
+package mapfile
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/color"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type lzoVector struct {
+	name string
+	in   []byte
+	out  []byte
+}
+
+// 按 LZO1X 的格式手写的流, 每种指令至少一个
+var lzoVectors = []lzoVector{
+	{"empty", []byte{0x11, 0, 0}, []byte{}},
+	{"literals", []byte{0x14, 'a', 'b', 'c', 0x11, 0, 0}, []byte("abc")},
+	// M3 距离1长度9, 重复前一个字节
+	{"m3 run", []byte{0x12, 'a', 0x27, 0, 0, 0x11, 0, 0}, []byte("aaaaaaaaaa")},
+	// M2 距离4长度4后跟2个字面量, 再接 M1 距离2长度2
+	{"m2 m1", []byte{0x15, 'a', 'b', 'c', 'd', 0x6e, 0, 'x', 'y', 0x04, 0, 0x11, 0, 0}, []byte("abcdabcdxyxy")},
+}
+
+func lzoLongLiteralVector() lzoVector {
+	// 2052 个字面量: 15 + 7*255 + 249 + 3, 然后是长字面量之后的 M1, 距离 0x801 长度3
+	literals := make([]byte, 2052)
+	for i := range literals {
+		literals[i] = byte(i * 7)
+	}
+	in := append([]byte{0, 0, 0, 0, 0, 0, 0, 0, 249}, literals...)
+	in = append(in, 0, 0, 0x11, 0, 0)
+	return lzoVector{"long literals m1", in, append(bytes.Clone(literals), literals[3:6]...)}
+}
+
+func lzoM4Vector() lzoVector {
+	// "ab" 后接长度 31+64*255+47+2 的 M3 复制, 再用 M4 从 0x4001 之前复制3个字节
+	in := []byte{0x13, 'a', 'b', 0x20}
+	in = append(in, make([]byte, 64)...)
+	in = append(in, 47, 0x04, 0, 0x11, 0x04, 0, 0x11, 0, 0)
+	out := bytes.Repeat([]byte("ab"), 8201)
+	return lzoVector{"m4", in, append(out, out[len(out)-0x4001:len(out)-0x4001+3]...)}
+}
+
+func TestDecompressLZO(t *testing.T) {
+	vectors := append(slices.Clone(lzoVectors), lzoLongLiteralVector(), lzoM4Vector())
+	for _, v := range vectors {
+		got, err := DecompressLZO(v.in, len(v.out))
+		if err != nil {
+			t.Errorf("%s: %v", v.name, err)
+			continue
+		}
+		if !bytes.Equal(got, v.out) {
+			t.Errorf("%s: got %d bytes, want %d", v.name, len(got), len(v.out))
+		}
+		// 截断的输入和长度对不上都要报错
+		for i := range v.in {
+			if _, err := DecompressLZO(v.in[:i], len(v.out)); !errors.Is(err, ErrCorruptLZO) {
+				t.Errorf("%s truncated to %d: err = %v", v.name, i, err)
+			}
+		}
+		if _, err := DecompressLZO(v.in, len(v.out)+1); !errors.Is(err, ErrCorruptLZO) {
+			t.Errorf("%s longer outLen: err = %v", v.name, err)
+		}
+		if len(v.out) > 0 {
+			if _, err := DecompressLZO(v.in, len(v.out)-1); !errors.Is(err, ErrCorruptLZO) {
+				t.Errorf("%s shorter outLen: err = %v", v.name, err)
+			}
+		}
+	}
+}
+
+func TestDecompressLZOMalformed(t *testing.T) {
+	for name, in := range map[string][]byte{
+		"distance before start": {0x12, 'a', 0x27, 0x04, 0, 0x11, 0, 0},
+		"literals past input":   {0x20, 'a'},
+		"endless length":        {0x00, 0, 0, 0},
+	} {
+		if _, err := DecompressLZO(in, 16); !errors.Is(err, ErrCorruptLZO) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+	// 随机输入不能 panic
+	rng := rand.New(rand.NewSource(1))
+	for range 5000 {
+		in := make([]byte, rng.Intn(64))
+		rng.Read(in)
+		DecompressLZO(in, rng.Intn(4096))
+	}
+}
+
+// 只有字面量的 LZO1X 流, 用来造测试用的压缩节, data 长度 1-238
+func lzoLiterals(data []byte) []byte {
+	out := append([]byte{byte(17 + len(data))}, data...)
+	return append(out, 0x11, 0, 0)
+}
+
+// 按块拼成 IsoMapPack5 / PreviewPack 解码后的格式
+func lzoPack(data []byte) []byte {
+	var out []byte
+	for len(data) > 0 {
+		n := min(len(data), 238)
+		chunk := lzoLiterals(data[:n])
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(chunk)))
+		out = binary.LittleEndian.AppendUint16(out, uint16(n))
+		out = append(out, chunk...)
+		data = data[n:]
+	}
+	return out
+}
+
+// 压缩节的ini文本, base64 每行70个字符, 行号从1开始
+func packSectionText(name string, data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var builder strings.Builder
+	builder.WriteString("[" + name + "]\n")
+	for i := 0; len(encoded) > 0; i++ {
+		n := min(len(encoded), 70)
+		fmt.Fprintf(&builder, "%d=%s\n", i+1, encoded[:n])
+		encoded = encoded[n:]
+	}
+	return builder.String()
+}
+
+func TestDecodePackSection(t *testing.T) {
+	// 行号按数字排序, 不是按出现顺序
+	ini := mustParseINI(t, "[P]\n2=Jj\n10=ZGVm\n1=YW\nx=ignored\n")
+	data, err := DecodePackSection(ini.Section("P"))
+	if err != nil || string(data) != "abcdef" {
+		t.Errorf("data = %q, err = %v", data, err)
+	}
+	ini = mustParseINI(t, "[P]\n1=!!!\n")
+	if _, err := DecodePackSection(ini.Section("P")); !errors.Is(err, ErrCorruptPack) {
+		t.Errorf("invalid base64: err = %v", err)
+	}
+}
+
+func TestDecompressLZOPack(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 60)
+	packed := lzoPack(data)
+	got, err := DecompressLZOPack(packed)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("round trip failed: %v", err)
+	}
+	for _, bad := range [][]byte{packed[:3], packed[:10], append(bytes.Clone(packed), 1, 0)} {
+		if _, err := DecompressLZOPack(bad); err == nil {
+			t.Errorf("truncated pack of %d bytes should fail", len(bad))
+		}
+	}
+}
+
+func TestPreview(t *testing.T) {
+	pixels := []byte{
+		0xff, 0, 0, 0, 0xff, 0,
+		0, 0, 0xff, 0x10, 0x20, 0x30,
+	}
+	ini := mustParseINI(t, "[Preview]\nSize=0,0,2,2\n"+packSectionText("PreviewPack", lzoPack(pixels)))
+	img, err := Preview(ini)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 2 || img.Bounds().Dy() != 2 {
+		t.Fatalf("bounds = %v", img.Bounds())
+	}
+	if got := color.RGBAModel.Convert(img.At(1, 1)); got != (color.RGBA{0x10, 0x20, 0x30, 0xff}) {
+		t.Errorf("pixel (1,1) = %v", got)
+	}
+	if got := color.RGBAModel.Convert(img.At(1, 0)); got != (color.RGBA{0, 0xff, 0, 0xff}) {
+		t.Errorf("pixel (1,0) = %v", got)
+	}
+}
+
+func TestPreviewInvalid(t *testing.T) {
+	pack := packSectionText("PreviewPack", lzoPack(make([]byte, 12)))
+	for name, text := range map[string]string{
+		"no pack":       "[Preview]\nSize=0,0,2,2\n",
+		"no size":       pack,
+		"zero size":     "[Preview]\nSize=0,0,0,2\n" + pack,
+		"too large":     "[Preview]\nSize=0,0,5000,5000\n" + pack,
+		"short pixels":  "[Preview]\nSize=0,0,3,3\n" + pack,
+		"corrupt lzo":   "[Preview]\nSize=0,0,2,2\n" + packSectionText("PreviewPack", []byte{5, 0, 12, 0, 0x20}),
+		"corrupt lines": "[Preview]\nSize=0,0,2,2\n[PreviewPack]\n1=@@@@\n",
+	} {
+		if _, err := Preview(mustParseINI(t, text)); err == nil {
+			t.Errorf("%s: expect error", name)
+		}
+	}
+	if _, err := Preview(mustParseINI(t, "[Preview]\nSize=0,0,2,2\n")); !errors.Is(err, ErrNoPreview) {
+		t.Errorf("err = %v, want ErrNoPreview", err)
+	}
+}
@@ -0,0 +1,142 @@
+package mapfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// 玩家出生点是 0-7 号路径点
+const MaxStartWaypoints = 8
+
+var ErrNotMap = errors.New("not a ra2/yr map file")
+
+type Point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// 从 [Basic] [Map] [Waypoints] 里读出来的地图信息
+type MapInfo struct {
+	Name       string        `json:"name"`
+	Author     string        `json:"author"`
+	MinPlayers int           `json:"min_players"`
+	MaxPlayers int           `json:"max_players"`
+	Theater    string        `json:"theater"`
+	Size       Rect          `json:"size"`
+	LocalSize  Rect          `json:"local_size"` // 可见区域
+	Waypoints  map[int]Point `json:"waypoints"`
+
+	GameModes       []string `json:"game_modes"` // [Basic] GameMode, 小写, 例如 standard meatgrind unholyalliance
+	MultiplayerOnly bool     `json:"multiplayer_only"`
+	Mission         bool     `json:"mission"` // 单人任务: [Basic] 指定了玩家的国家, 或者有任务简报
+}
+
+// 解析 .map/.mpr/.yrm, 三者都是同样的ini结构
+func Parse(r io.Reader) (*MapInfo, error) {
+	ini, err := ParseINI(r)
+	if err != nil {
+		return nil, err
+	}
+	return ReadInfo(ini)
+}
+
+// 没有 [Map] 节或者 Size 不对就认为不是地图
+func ReadInfo(ini *INI) (*MapInfo, error) {
+	mapSection := ini.Section("Map")
+	if mapSection == nil {
+		return nil, ErrNotMap
+	}
+	size, err := parseRect(mapSection.String("Size", ""))
+	if err != nil {
+		return nil, fmt.Errorf("%w : [Map] Size %v", ErrNotMap, err)
+	}
+	localSize, err := parseRect(mapSection.String("LocalSize", ""))
+	if err != nil {
+		localSize = size
+	}
+
+	basic := ini.Section("Basic")
+	info := &MapInfo{
+		Name:      basic.String("Name", ""),
+		Author:    basic.String("Author", ""),
+		Theater:   mapSection.String("Theater", ""),
+		Size:      size,
+		LocalSize: localSize,
+		Waypoints: readWaypoints(ini.Section("Waypoints")),
+	}
+
+	// 没写人数的地图按出生点个数算
+	starts := 0
+	for i := 0; i < MaxStartWaypoints; i++ {
+		if _, ok := info.Waypoints[i]; ok {
+			starts++
+		}
+	}
+	info.MaxPlayers = basic.Int("MaxPlayer", starts)
+	info.MinPlayers = basic.Int("MinPlayer", min(info.MaxPlayers, 2))
+
+	info.GameModes = parseGameModes(basic.String("GameMode", ""))
+	info.MultiplayerOnly = basic.Bool("MultiplayerOnly", false)
+	_, hasBriefing := basic.Get("Briefing")
+	info.Mission = !info.MultiplayerOnly &&
+		(basic.String("Player", "") != "" || hasBriefing || ini.Section("Briefing") != nil)
+	return info, nil
+}
+
+// GameMode 是逗号分隔的模式列表, 去掉空的和重复的
+func parseGameModes(value string) []string {
+	var modes []string
+	for _, mode := range strings.Split(value, ",") {
+		mode = strings.ToLower(strings.TrimSpace(mode))
+		if mode != "" && !slices.Contains(modes, mode) {
+			modes = append(modes, mode)
+		}
+	}
+	return modes
+}
+
+// "x,y,width,height"
+func parseRect(value string) (Rect, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return Rect{}, fmt.Errorf("invalid rect %q", value)
+	}
+	var nums [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return Rect{}, fmt.Errorf("invalid rect %q", value)
+		}
+		nums[i] = n
+	}
+	return Rect{X: nums[0], Y: nums[1], Width: nums[2], Height: nums[3]}, nil
+}
+
+// 路径点的值是 y*1000+x, 格式不对的直接跳过
+func readWaypoints(section *Section) map[int]Point {
+	waypoints := make(map[int]Point)
+	for _, key := range section.Keys() {
+		index, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		value, _ := section.Get(key)
+		cell, err := strconv.Atoi(value)
+		if err != nil || cell < 0 {
+			continue
+		}
+		waypoints[index] = Point{X: cell % 1000, Y: cell / 1000}
+	}
+	return waypoints
+}
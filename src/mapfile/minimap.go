@@ -0,0 +1,218 @@
+package mapfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+)
+
+const (
+	// OverlayPack 和 OverlayDataPack 都是 512x512, 下标是 y*512+x
+	overlayDimension = 512
+	overlayNone      = 0xff
+	// 矿和宝石在 OverlayDataPack 里的帧号, 0-11 越大矿越多
+	maxOreDensity = 11
+
+	maxLevel = 14
+
+	// 出生点标记的边长
+	startMarkerSize = 7
+)
+
+var ErrNoIsoMapPack = errors.New("map has no IsoMapPack5")
+
+// IsoMapPack5 里的一个格子
+type IsoCell struct {
+	X         int
+	Y         int
+	TileIndex int
+	SubTile   int
+	Level     int
+}
+
+type OverlayClass int
+
+const (
+	OverlayOther OverlayClass = iota
+	OverlayOre
+	OverlayGems
+	OverlayWall
+)
+
+// 原版 rulesmd.ini [OverlayTypes] 里的下标, 只区分小地图上要画出来的几类
+func classifyOverlay(index int) OverlayClass {
+	switch {
+	case index >= 102 && index <= 121, index >= 127 && index <= 146: // 金矿
+		return OverlayOre
+	case index >= 27 && index <= 38, index >= 147 && index <= 166: // 宝石
+		return OverlayGems
+	case index <= 2 || index == 26: // 沙袋, 铁丝网, 围墙
+		return OverlayWall
+	}
+	return OverlayOther
+}
+
+var (
+	theaterColors = map[string]color.RGBA{
+		"TEMPERATE": {R: 0x5a, G: 0x7a, B: 0x3a, A: 0xff},
+		"SNOW":      {R: 0xc8, G: 0xd0, B: 0xd8, A: 0xff},
+		"URBAN":     {R: 0x70, G: 0x74, B: 0x6c, A: 0xff},
+		"NEWURBAN":  {R: 0x6c, G: 0x70, B: 0x60, A: 0xff},
+		"DESERT":    {R: 0xc0, G: 0xa8, B: 0x70, A: 0xff},
+		"LUNAR":     {R: 0x80, G: 0x80, B: 0x88, A: 0xff},
+	}
+	overlayColors = map[OverlayClass]color.RGBA{
+		OverlayOther: {R: 0x50, G: 0x48, B: 0x40, A: 0xff},
+		OverlayOre:   {R: 0xe0, G: 0xb0, B: 0x20, A: 0xff},
+		OverlayGems:  {R: 0x30, G: 0xc0, B: 0xe0, A: 0xff},
+		OverlayWall:  {R: 0x30, G: 0x30, B: 0x30, A: 0xff},
+	}
+	// 和游戏里默认的玩家颜色顺序一致
+	startColors = []color.RGBA{
+		{R: 0xf0, G: 0xd0, B: 0x00, A: 0xff},
+		{R: 0xe0, G: 0x20, B: 0x20, A: 0xff},
+		{R: 0x30, G: 0x60, B: 0xf0, A: 0xff},
+		{R: 0x30, G: 0xc0, B: 0x30, A: 0xff},
+		{R: 0xf0, G: 0x80, B: 0x10, A: 0xff},
+		{R: 0x30, G: 0xd0, B: 0xd0, A: 0xff},
+		{R: 0xa0, G: 0x40, B: 0xe0, A: 0xff},
+		{R: 0xf0, G: 0x80, B: 0xc0, A: 0xff},
+	}
+)
+
+// 解出 IsoMapPack5 里的所有格子
+func ReadIsoCells(ini *INI) ([]IsoCell, error) {
+	section := ini.Section("IsoMapPack5")
+	if section == nil || len(section.Keys()) == 0 {
+		return nil, ErrNoIsoMapPack
+	}
+	data, err := DecodePackSection(section)
+	if err != nil {
+		return nil, err
+	}
+	data, err = DecompressLZOPack(data)
+	if err != nil {
+		return nil, err
+	}
+
+	cells := make([]IsoCell, 0, len(data)/isoCellSize)
+	for i := 0; i+isoCellSize <= len(data); i += isoCellSize {
+		record := data[i : i+isoCellSize]
+		cells = append(cells, IsoCell{
+			X:         int(binary.LittleEndian.Uint16(record[0:2])),
+			Y:         int(binary.LittleEndian.Uint16(record[2:4])),
+			TileIndex: int(int32(binary.LittleEndian.Uint32(record[4:8]))),
+			SubTile:   int(record[8]),
+			Level:     int(record[9]),
+		})
+	}
+	return cells, nil
+}
+
+// 解出 OverlayPack 或 OverlayDataPack, 没有或者解不开时返回nil.
+// 没有 OverlayPack 小地图上就不画覆盖物, 没有 OverlayDataPack 矿和宝石都按最密的画
+func readOverlayPack(ini *INI, name string) []byte {
+	section := ini.Section(name)
+	if section == nil {
+		return nil
+	}
+	data, err := DecodePackSection(section)
+	if err != nil {
+		return nil
+	}
+	data, err = DecompressFormat80Pack(data)
+	if err != nil || len(data) < overlayDimension*overlayDimension {
+		return nil
+	}
+	return data
+}
+
+// 俯视的等角小地图: 每个格子画成 4x2 像素, 地形按剧场上色再按高度调亮度,
+// 矿, 宝石和墙用固定颜色, 0-7 号路径点画成玩家颜色的方块
+func Minimap(ini *INI) (image.Image, error) {
+	info, err := ReadInfo(ini)
+	if err != nil {
+		return nil, err
+	}
+	cells, err := ReadIsoCells(ini)
+	if err != nil {
+		return nil, err
+	}
+	width, height := info.Size.Width, info.Size.Height
+	if width <= 0 || height <= 0 || width > overlayDimension || height > overlayDimension {
+		return nil, fmt.Errorf("invalid map size %dx%d", width, height)
+	}
+
+	base, ok := theaterColors[strings.ToUpper(info.Theater)]
+	if !ok {
+		base = theaterColors["TEMPERATE"]
+	}
+	overlay := readOverlayPack(ini, "OverlayPack")
+	overlayData := readOverlayPack(ini, "OverlayDataPack")
+
+	img := image.NewRGBA(image.Rect(0, 0, width*4, height*2+2))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{A: 0xff}), image.Point{}, draw.Src)
+
+	for _, cell := range cells {
+		c := shade(base, cell.Level)
+		if overlay != nil && cell.X < overlayDimension && cell.Y < overlayDimension {
+			offset := cell.Y*overlayDimension + cell.X
+			if index := overlay[offset]; index != overlayNone {
+				class := classifyOverlay(int(index))
+				c = overlayColors[class]
+				if overlayData != nil && (class == OverlayOre || class == OverlayGems) {
+					c = oreDensity(c, int(overlayData[offset]))
+				}
+			}
+		}
+		x, y := project(cell.X, cell.Y, width)
+		fillRect(img, x, y, 4, 2, c)
+	}
+
+	for i := 0; i < MaxStartWaypoints; i++ {
+		point, ok := info.Waypoints[i]
+		if !ok {
+			continue
+		}
+		x, y := project(point.X, point.Y, width)
+		x, y = x+2-startMarkerSize/2, y+1-startMarkerSize/2
+		fillRect(img, x-1, y-1, startMarkerSize+2, startMarkerSize+2, color.RGBA{A: 0xff})
+		fillRect(img, x, y, startMarkerSize, startMarkerSize, startColors[i])
+	}
+	return img, nil
+}
+
+// 格子坐标到像素坐标, 和游戏里一样 x 往右下, y 往左下
+func project(cellX int, cellY int, width int) (int, int) {
+	dx := cellX - cellY + width - 1
+	dy := cellX + cellY - width - 1
+	return dx * 2, dy
+}
+
+// 高度0最暗, 每升一级亮一点
+func shade(c color.RGBA, level int) color.RGBA {
+	level = min(max(level, 0), maxLevel)
+	factor := 0.7 + 0.45*float64(level)/maxLevel
+	scale := func(v uint8) uint8 {
+		return uint8(min(float64(v)*factor, 0xff))
+	}
+	return color.RGBA{R: scale(c.R), G: scale(c.G), B: scale(c.B), A: 0xff}
+}
+
+// 矿越少越暗, 最少的是最多的 60% 亮度
+func oreDensity(c color.RGBA, frame int) color.RGBA {
+	frame = min(max(frame, 0), maxOreDensity)
+	factor := 0.6 + 0.4*float64(frame)/maxOreDensity
+	scale := func(v uint8) uint8 {
+		return uint8(float64(v) * factor)
+	}
+	return color.RGBA{R: scale(c.R), G: scale(c.G), B: scale(c.B), A: 0xff}
+}
+
+func fillRect(img *image.RGBA, x int, y int, w int, h int, c color.RGBA) {
+	draw.Draw(img, image.Rect(x, y, x+w, y+h).Intersect(img.Bounds()), image.NewUniform(c), image.Point{}, draw.Src)
+}
@@ -0,0 +1,126 @@
+package mapfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func isoCell(x, y, level int) []byte {
+	var cell []byte
+	cell = binary.LittleEndian.AppendUint16(cell, uint16(x))
+	cell = binary.LittleEndian.AppendUint16(cell, uint16(y))
+	cell = binary.LittleEndian.AppendUint32(cell, 0)
+	return append(cell, 0, byte(level), 0)
+}
+
+// 10x10 的地图, 四个格子: 平地, 金矿, 宝石和高地上的墙, 0号路径点在 (10,10)
+func testMinimapINI(t *testing.T, overlay bool, overlayData bool) *INI {
+	var cells []byte
+	cells = append(cells, isoCell(6, 6, 0)...)
+	cells = append(cells, isoCell(8, 6, 0)...)
+	cells = append(cells, isoCell(6, 8, 0)...)
+	cells = append(cells, isoCell(7, 7, 4)...)
+	text := "[Basic]\n[Map]\nSize=0,0,10,10\nTheater=SNOW\n[Waypoints]\n0=10010\n" +
+		packSectionText("IsoMapPack5", lzoPack(cells))
+
+	if overlay {
+		data := make([]byte, overlayDimension*overlayDimension)
+		for i := range data {
+			data[i] = overlayNone
+		}
+		data[6*overlayDimension+8] = 102 // 金矿
+		data[8*overlayDimension+6] = 27  // 宝石
+		data[7*overlayDimension+7] = 0   // 沙袋
+		text += packSectionText("OverlayPack", format80Pack(data))
+	}
+	if overlayData {
+		data := make([]byte, overlayDimension*overlayDimension)
+		data[8*overlayDimension+6] = maxOreDensity
+		text += packSectionText("OverlayDataPack", format80Pack(data))
+	}
+	return mustParseINI(t, text)
+}
+
+func pixel(img image.Image, x, y int) color.RGBA {
+	return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+}
+
+func TestMinimap(t *testing.T) {
+	img, err := Minimap(testMinimapINI(t, true, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 40, 22) {
+		t.Fatalf("bounds = %v", img.Bounds())
+	}
+	snow := theaterColors["SNOW"]
+	for _, c := range []struct {
+		name string
+		x, y int
+		want color.RGBA
+	}{
+		{"terrain", 18, 1, shade(snow, 0)},
+		{"sparse ore", 22, 3, oreDensity(overlayColors[OverlayOre], 0)},
+		{"dense gems", 14, 3, overlayColors[OverlayGems]},
+		{"wall", 18, 3, overlayColors[OverlayWall]},
+		{"start marker", 20, 10, startColors[0]},
+		{"marker border", 16, 6, color.RGBA{A: 0xff}},
+		{"background", 0, 0, color.RGBA{A: 0xff}},
+	} {
+		if got := pixel(img, c.x, c.y); got != c.want {
+			t.Errorf("%s at (%d,%d) = %v, want %v", c.name, c.x, c.y, got, c.want)
+		}
+	}
+	if oreDensity(overlayColors[OverlayOre], 0) == overlayColors[OverlayOre] {
+		t.Error("sparse ore should be darker")
+	}
+	if shade(snow, 4) == shade(snow, 0) {
+		t.Error("higher cells should be brighter")
+	}
+}
+
+// 没有 OverlayDataPack 时矿按最密的画, 没有 OverlayPack 时只画地形
+func TestMinimapMissingOverlay(t *testing.T) {
+	img, err := Minimap(testMinimapINI(t, true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pixel(img, 22, 3); got != overlayColors[OverlayOre] {
+		t.Errorf("ore = %v", got)
+	}
+
+	img, err = Minimap(testMinimapINI(t, false, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pixel(img, 22, 3); got != shade(theaterColors["SNOW"], 0) {
+		t.Errorf("terrain = %v", got)
+	}
+}
+
+func TestMinimapInvalid(t *testing.T) {
+	iso := packSectionText("IsoMapPack5", lzoPack(isoCell(6, 6, 0)))
+	if _, err := Minimap(mustParseINI(t, "[Map]\nSize=0,0,10,10\n")); !errors.Is(err, ErrNoIsoMapPack) {
+		t.Errorf("no iso: err = %v", err)
+	}
+	if _, err := Minimap(mustParseINI(t, iso)); !errors.Is(err, ErrNotMap) {
+		t.Errorf("no map: err = %v", err)
+	}
+	for name, text := range map[string]string{
+		"too large":   "[Map]\nSize=0,0,600,10\n" + iso,
+		"zero size":   "[Map]\nSize=0,0,0,10\n" + iso,
+		"corrupt iso": "[Map]\nSize=0,0,10,10\n" + packSectionText("IsoMapPack5", []byte{9, 0, 11, 0, 0x1c, 1}),
+	} {
+		if _, err := Minimap(mustParseINI(t, text)); err == nil {
+			t.Errorf("%s: expect error", name)
+		}
+	}
+	// 解不开的覆盖物当作没有
+	text := "[Map]\nSize=0,0,10,10\n" + iso + packSectionText("OverlayPack", []byte{4, 0, 0, 1, 0xfe, 0xff})
+	if _, err := Minimap(mustParseINI(t, text)); err != nil {
+		t.Errorf("corrupt overlay: %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package mapfile
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/big"
+	"sync"
+
+	"golang.org/x/crypto/blowfish"
+)
+
+var ErrCorruptMix = errors.New("corrupt mix file")
+
+const (
+	mixFlagChecksum  = 0x00010000
+	mixFlagEncrypted = 0x00020000
+
+	mixEntrySize    = 12
+	mixKeySourceLen = 80
+	mixKeyLen       = 56
+
+	// XCC 写进mix里的文件名列表
+	mixLocalDatabase = "local mix database.dat"
+	xccHeaderSize    = 48
+)
+
+// 西木加密mix头用的RSA公钥, DER编码的模数, 指数是65537
+const westwoodPublicKey = "AihRvNoIbTn85FZRYNZRcT+i6KpU+maCsEqr3Q5q+LDB5tH7Tz2qQ38V"
+
+var westwoodModulus = sync.OnceValue(func() *big.Int {
+	der, err := base64.StdEncoding.DecodeString(westwoodPublicKey)
+	if err != nil || len(der) < 2 || der[0] != 0x02 || int(der[1]) != len(der)-2 {
+		panic("invalid westwood public key")
+	}
+	return new(big.Int).SetBytes(der[2:])
+})
+
+type MixEntry struct {
+	ID     uint32
+	Offset uint32
+	Size   uint32
+	Name   string // 没有文件名列表时为空
+}
+
+// 没有名字的用ID表示
+func (e MixEntry) DisplayName() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return fmt.Sprintf("%08X", e.ID)
+}
+
+// 西木的mix包, 支持TD/RA1的旧格式和TS/RA2的新格式(包括加密的头)
+type Mix struct {
+	r         io.ReaderAt
+	dataStart int64
+	Encrypted bool
+	Entries   []MixEntry
+}
+
+// TS/RA2 的文件ID: 大写后按4字节补齐再算crc32
+func MixID(name string) uint32 {
+	return mixID([]byte(name))
+}
+
+// 游戏只转换ascii的大小写, 文件名列表里的GBK名字要按原始字节算
+func mixID(name []byte) uint32 {
+	data := make([]byte, len(name), len(name)+3)
+	for i, b := range name {
+		if 'a' <= b && b <= 'z' {
+			b -= 'a' - 'A'
+		}
+		data[i] = b
+	}
+	if rest := len(data) % 4; rest != 0 {
+		aligned := len(data) - rest
+		data = append(data, byte(rest))
+		for i := 3 - rest; i > 0; i-- {
+			data = append(data, data[aligned])
+		}
+	}
+	return crc32.ChecksumIEEE(data)
+}
+
+func OpenMix(r io.ReaderAt, size int64) (*Mix, error) {
+	var head [4]byte
+	if _, err := r.ReadAt(head[:], 0); err != nil {
+		return nil, fmt.Errorf("%w : %v", ErrCorruptMix, err)
+	}
+
+	mix := &Mix{r: r}
+	var header []byte
+	var err error
+	if binary.LittleEndian.Uint16(head[:]) != 0 {
+		// 旧格式没有flags, 开头直接是文件数
+		header, mix.dataStart, err = readPlainMixHeader(r, 0)
+	} else {
+		flags := binary.LittleEndian.Uint32(head[:])
+		if flags&^(mixFlagChecksum|mixFlagEncrypted) != 0 {
+			return nil, fmt.Errorf("%w : unknown flags %#x", ErrCorruptMix, flags)
+		}
+		mix.Encrypted = flags&mixFlagEncrypted != 0
+		if mix.Encrypted {
+			header, mix.dataStart, err = readEncryptedMixHeader(r, 4)
+		} else {
+			header, mix.dataStart, err = readPlainMixHeader(r, 4)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	count := int(binary.LittleEndian.Uint16(header))
+	for i := range count {
+		raw := header[6+i*mixEntrySize:]
+		entry := MixEntry{
+			ID:     binary.LittleEndian.Uint32(raw),
+			Offset: binary.LittleEndian.Uint32(raw[4:]),
+			Size:   binary.LittleEndian.Uint32(raw[8:]),
+		}
+		if mix.dataStart+int64(entry.Offset)+int64(entry.Size) > size {
+			return nil, fmt.Errorf("%w : entry %08X out of range", ErrCorruptMix, entry.ID)
+		}
+		mix.Entries = append(mix.Entries, entry)
+	}
+	mix.readNames()
+	return mix, nil
+}
+
+// 头: 文件数 u16, 数据大小 u32, 然后是每个文件12字节的索引
+func readPlainMixHeader(r io.ReaderAt, start int64) ([]byte, int64, error) {
+	var count [2]byte
+	if _, err := r.ReadAt(count[:], start); err != nil {
+		return nil, 0, fmt.Errorf("%w : %v", ErrCorruptMix, err)
+	}
+	header := make([]byte, 6+int(binary.LittleEndian.Uint16(count[:]))*mixEntrySize)
+	if _, err := r.ReadAt(header, start); err != nil {
+		return nil, 0, fmt.Errorf("%w : %v", ErrCorruptMix, err)
+	}
+	return header, start + int64(len(header)), nil
+}
+
+// 加密的头前面有80字节的密钥, 用公钥解出blowfish密钥, 头按8字节块加密
+func readEncryptedMixHeader(r io.ReaderAt, start int64) ([]byte, int64, error) {
+	keySource := make([]byte, mixKeySourceLen)
+	if _, err := r.ReadAt(keySource, start); err != nil {
+		return nil, 0, fmt.Errorf("%w : %v", ErrCorruptMix, err)
+	}
+	block, err := blowfish.NewCipher(decryptMixKey(keySource))
+	if err != nil {
+		return nil, 0, err
+	}
+	start += mixKeySourceLen
+
+	// 先解第一块拿到文件数, 再按块数读整个头
+	first := make([]byte, blowfish.BlockSize)
+	if _, err := r.ReadAt(first, start); err != nil {
+		return nil, 0, fmt.Errorf("%w : %v", ErrCorruptMix, err)
+	}
+	decryptMixBlocks(block, first)
+	count := int(binary.LittleEndian.Uint16(first))
+	length := (6 + count*mixEntrySize + blowfish.BlockSize - 1) / blowfish.BlockSize * blowfish.BlockSize
+	header := make([]byte, length)
+	if _, err := r.ReadAt(header, start); err != nil {
+		return nil, 0, fmt.Errorf("%w : %v", ErrCorruptMix, err)
+	}
+	decryptMixBlocks(block, header)
+	return header, start + int64(length), nil
+}
+
+// 密钥按40字节一组(小端)做RSA公钥运算, 每组得到39字节, 拼起来的前56字节是blowfish密钥
+func decryptMixKey(source []byte) []byte {
+	modulus := westwoodModulus()
+	exponent := big.NewInt(65537)
+	inLen := (modulus.BitLen()-2)/8 + 1
+	outLen := inLen - 1
+
+	var key []byte
+	for len(source) >= inLen {
+		value := new(big.Int).SetBytes(reverseBytes(source[:inLen]))
+		value.Exp(value, exponent, modulus)
+		out := make([]byte, outLen)
+		copy(out, reverseBytes(value.Bytes()))
+		key = append(key, out...)
+		source = source[inLen:]
+	}
+	if len(key) < mixKeyLen {
+		key = append(key, make([]byte, mixKeyLen-len(key))...)
+	}
+	return key[:mixKeyLen]
+}
+
+// 西木的blowfish按小端读写32位字, x/crypto 是大端, 解密前后都要把每个字翻转一下
+func decryptMixBlocks(block cipher.Block, data []byte) {
+	for i := 0; i+blowfish.BlockSize <= len(data); i += blowfish.BlockSize {
+		chunk := data[i : i+blowfish.BlockSize]
+		swapWords(chunk)
+		block.Decrypt(chunk, chunk)
+		swapWords(chunk)
+	}
+}
+
+func swapWords(data []byte) {
+	for i := 0; i+4 <= len(data); i += 4 {
+		data[i], data[i+1], data[i+2], data[i+3] = data[i+3], data[i+2], data[i+1], data[i]
+	}
+}
+
+func reverseBytes(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[len(data)-1-i] = b
+	}
+	return out
+}
+
+// 包里有 XCC 的文件名列表就用它给文件补上名字
+func (m *Mix) readNames() {
+	databaseID := MixID(mixLocalDatabase)
+	var data []byte
+	for _, entry := range m.Entries {
+		if entry.ID == databaseID {
+			data = make([]byte, entry.Size)
+			if _, err := io.ReadFull(m.Open(entry), data); err != nil {
+				return
+			}
+			break
+		}
+	}
+	if len(data) < xccHeaderSize+4 {
+		return
+	}
+
+	names := make(map[uint32]string)
+	names[databaseID] = mixLocalDatabase
+	count := int(binary.LittleEndian.Uint32(data[xccHeaderSize:]))
+	rest := data[xccHeaderSize+4:]
+	for i := 0; i < count && len(rest) > 0; i++ {
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			end = len(rest)
+		}
+		names[mixID(rest[:end])] = DecodeText(rest[:end])
+		rest = rest[min(end+1, len(rest)):]
+	}
+	for i := range m.Entries {
+		m.Entries[i].Name = names[m.Entries[i].ID]
+	}
+}
+
+// 读取包里的一个文件
+func (m *Mix) Open(entry MixEntry) *io.SectionReader {
+	return io.NewSectionReader(m.r, m.dataStart+int64(entry.Offset), int64(entry.Size))
+}
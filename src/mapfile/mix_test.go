@@ -0,0 +1,222 @@
+package mapfile
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/crypto/blowfish"
+)
+
+// 西木公钥对应的私钥指数, 只在测试里用来造加密的头
+const westwoodPrivateKey = "AigKVje8mROcR8QixnxUEF5b29Curkq01DNDWCdOG99XBqH79OaCiTCB"
+
+func TestMixID(t *testing.T) {
+	for name, want := range map[string]uint32{
+		"local mix database.dat": 0x366E051F, // XCC 文件名列表的ID
+		"a":                      0xEB978531,
+		"ab":                     0x421FAA6E,
+		"abc":                    0x33AFF496,
+		"abcd":                   0xDB1720A5,
+		"rulesmd.ini":            0x8218F9F4,
+		"RULESMD.INI":            0x8218F9F4,
+	} {
+		if got := MixID(name); got != want {
+			t.Errorf("MixID(%q) = %08X, want %08X", name, got, want)
+		}
+	}
+}
+
+// 80 字节的密钥源按40字节一组做公钥运算
+func TestDecryptMixKey(t *testing.T) {
+	source := make([]byte, mixKeySourceLen)
+	for i := range source {
+		source[i] = byte(i)
+	}
+	want := "fd0b077d5780a7d08d96681dcbe1bea9450e77fcba6632451c94208a0711274b905a205f5aff6bc04d920b8f3d2f29868be2030a36d40c8e"
+	if got := hex.EncodeToString(decryptMixKey(source)); got != want {
+		t.Errorf("key = %s, want %s", got, want)
+	}
+}
+
+type testMixFile struct {
+	name string
+	data []byte
+}
+
+// 文件数 u16, 数据大小 u32, 每个文件 ID, 偏移, 大小
+func mixIndex(files []testMixFile) ([]byte, []byte) {
+	var index, body []byte
+	index = binary.LittleEndian.AppendUint16(index, uint16(len(files)))
+	for _, f := range files {
+		body = append(body, f.data...)
+	}
+	index = binary.LittleEndian.AppendUint32(index, uint32(len(body)))
+	offset := 0
+	for _, f := range files {
+		index = binary.LittleEndian.AppendUint32(index, MixID(f.name))
+		index = binary.LittleEndian.AppendUint32(index, uint32(offset))
+		index = binary.LittleEndian.AppendUint32(index, uint32(len(f.data)))
+		offset += len(f.data)
+	}
+	return index, body
+}
+
+// XCC 的文件名列表: 48 字节头, 个数, 以0结尾的名字
+func mixLocalDatabaseFile(names ...string) testMixFile {
+	data := make([]byte, xccHeaderSize)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(names)))
+	for _, name := range names {
+		data = append(append(data, name...), 0)
+	}
+	return testMixFile{mixLocalDatabase, data}
+}
+
+func buildOldMix(files []testMixFile) []byte {
+	index, body := mixIndex(files)
+	return append(index, body...)
+}
+
+func buildMix(flags uint32, files []testMixFile) []byte {
+	index, body := mixIndex(files)
+	out := binary.LittleEndian.AppendUint32(nil, flags)
+	return append(append(out, index...), body...)
+}
+
+// 用私钥把 blowfish 密钥做成密钥源, 头按西木的字节序加密
+func buildEncryptedMix(t *testing.T, key []byte, files []testMixFile) []byte {
+	der, err := base64.StdEncoding.DecodeString(westwoodPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exponent := new(big.Int).SetBytes(der[2:])
+	modulus := westwoodModulus()
+
+	padded := append(bytes.Clone(key), make([]byte, 2*39-len(key))...)
+	var source []byte
+	for i := 0; i < len(padded); i += 39 {
+		value := new(big.Int).SetBytes(reverseBytes(padded[i : i+39]))
+		value.Exp(value, exponent, modulus)
+		block := make([]byte, 40)
+		copy(block, reverseBytes(value.Bytes()))
+		source = append(source, block...)
+	}
+
+	index, body := mixIndex(files)
+	index = append(index, make([]byte, (8-len(index)%8)%8)...)
+	block, err := blowfish.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(index); i += blowfish.BlockSize {
+		chunk := index[i : i+blowfish.BlockSize]
+		swapWords(chunk)
+		block.Encrypt(chunk, chunk)
+		swapWords(chunk)
+	}
+
+	out := binary.LittleEndian.AppendUint32(nil, mixFlagEncrypted|mixFlagChecksum)
+	out = append(out, source...)
+	out = append(out, index...)
+	return append(out, body...)
+}
+
+func testMixFiles() []testMixFile {
+	return []testMixFile{
+		{"tiny.yrm", []byte("[Basic]\nName=tiny\n")},
+		{"other.map", []byte("[Map]\nSize=0,0,1,1\n")},
+	}
+}
+
+func checkMix(t *testing.T, name string, data []byte, named bool) *Mix {
+	t.Helper()
+	mix, err := OpenMix(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	files := testMixFiles()
+	for i, f := range files {
+		entry := mix.Entries[i]
+		if entry.ID != MixID(f.name) {
+			t.Errorf("%s: entry %d id = %08X", name, i, entry.ID)
+		}
+		content, err := io.ReadAll(mix.Open(entry))
+		if err != nil || !bytes.Equal(content, f.data) {
+			t.Errorf("%s: entry %d content = %q, err = %v", name, i, content, err)
+		}
+		wantName := ""
+		if named {
+			wantName = f.name
+		}
+		if entry.Name != wantName {
+			t.Errorf("%s: entry %d name = %q, want %q", name, i, entry.Name, wantName)
+		}
+	}
+	return mix
+}
+
+func TestOpenMix(t *testing.T) {
+	files := testMixFiles()
+	checkMix(t, "old format", buildOldMix(files), false)
+	checkMix(t, "new format", buildMix(0, files), false)
+	checkMix(t, "checksum flag", buildMix(mixFlagChecksum, files), false)
+
+	named := append(testMixFiles(), mixLocalDatabaseFile("tiny.yrm", "other.map"))
+	mix := checkMix(t, "with names", buildMix(0, named), true)
+	if mix.Entries[0].DisplayName() != "tiny.yrm" {
+		t.Errorf("display name = %s", mix.Entries[0].DisplayName())
+	}
+	if got := (MixEntry{ID: 0x8218F9F4}).DisplayName(); got != "8218F9F4" {
+		t.Errorf("display name without name = %s", got)
+	}
+}
+
+func TestOpenEncryptedMix(t *testing.T) {
+	key := make([]byte, mixKeyLen)
+	for i := range key {
+		key[i] = byte(i*31 + 7)
+	}
+	data := buildEncryptedMix(t, key, append(testMixFiles(), mixLocalDatabaseFile("tiny.yrm", "other.map")))
+	mix := checkMix(t, "encrypted", data, true)
+	if !mix.Encrypted {
+		t.Error("Encrypted should be set")
+	}
+}
+
+// 截断和乱写的包都要报错, 不能 panic
+func TestOpenMixMalformed(t *testing.T) {
+	key := make([]byte, mixKeyLen)
+	for name, data := range map[string][]byte{
+		"old":       buildOldMix(testMixFiles()),
+		"new":       buildMix(0, testMixFiles()),
+		"encrypted": buildEncryptedMix(t, key, testMixFiles()),
+	} {
+		for i := range len(data) {
+			if _, err := OpenMix(bytes.NewReader(data[:i]), int64(i)); err == nil {
+				t.Errorf("%s truncated to %d: expect error", name, i)
+			}
+		}
+	}
+
+	data := buildMix(0, testMixFiles())
+	binary.LittleEndian.PutUint32(data, 0x00040000)
+	if _, err := OpenMix(bytes.NewReader(data), int64(len(data))); !errors.Is(err, ErrCorruptMix) {
+		t.Errorf("unknown flags: err = %v", err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for range 2000 {
+		data := make([]byte, rng.Intn(256))
+		rng.Read(data)
+		if len(data) >= 4 && rng.Intn(2) == 0 {
+			binary.LittleEndian.PutUint32(data, mixFlagEncrypted)
+		}
+		OpenMix(bytes.NewReader(data), int64(len(data)))
+	}
+}
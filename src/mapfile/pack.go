@@ -0,0 +1,74 @@
+package mapfile
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var ErrCorruptPack = errors.New("corrupt pack section")
+
+// [IsoMapPack5] [PreviewPack] 这类节: 键是从1开始的行号, 值是base64, 按行号拼起来再解码
+func DecodePackSection(section *Section) ([]byte, error) {
+	type line struct {
+		index int
+		value string
+	}
+	var lines []line
+	for _, key := range section.Keys() {
+		index, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		value, _ := section.Get(key)
+		lines = append(lines, line{index, value})
+	}
+	slices.SortFunc(lines, func(a, b line) int { return a.index - b.index })
+
+	var builder strings.Builder
+	for _, l := range lines {
+		builder.WriteString(l.value)
+	}
+	data, err := base64.StdEncoding.DecodeString(builder.String())
+	if err != nil {
+		return nil, fmt.Errorf("%w : %v", ErrCorruptPack, err)
+	}
+	return data, nil
+}
+
+// 解码后的数据由若干块组成, 每块是 uint16 压缩长度 + uint16 原始长度 + 压缩数据
+func decompressPack(data []byte, decompress func([]byte, int) ([]byte, error)) ([]byte, error) {
+	var out []byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, ErrCorruptPack
+		}
+		inSize := int(binary.LittleEndian.Uint16(data[0:2]))
+		outSize := int(binary.LittleEndian.Uint16(data[2:4]))
+		data = data[4:]
+		if inSize > len(data) {
+			return nil, ErrCorruptPack
+		}
+		chunk, err := decompress(data[:inSize], outSize)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk...)
+		data = data[inSize:]
+	}
+	return out, nil
+}
+
+// IsoMapPack5, PreviewPack
+func DecompressLZOPack(data []byte) ([]byte, error) {
+	return decompressPack(data, DecompressLZO)
+}
+
+// OverlayPack, OverlayDataPack
+func DecompressFormat80Pack(data []byte) ([]byte, error) {
+	return decompressPack(data, DecompressFormat80)
+}
@@ -0,0 +1,52 @@
+package mapfile
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// 防止 [Preview] 里写了离谱的尺寸, 游戏里的预览图一般不超过 400x300
+const maxPreviewPixels = 4096 * 4096
+
+var ErrNoPreview = errors.New("map has no preview")
+
+// 从 [Preview] Size 和 [PreviewPack] 解出预览图, 像素是RGB顺序的24位色
+func Preview(ini *INI) (image.Image, error) {
+	pack := ini.Section("PreviewPack")
+	if pack == nil || len(pack.Keys()) == 0 {
+		return nil, ErrNoPreview
+	}
+	size, err := parseRect(ini.Section("Preview").String("Size", ""))
+	if err != nil {
+		return nil, fmt.Errorf("%w : [Preview] Size %v", ErrNoPreview, err)
+	}
+	if size.Width <= 0 || size.Height <= 0 {
+		return nil, ErrNoPreview
+	}
+	if size.Width*size.Height > maxPreviewPixels {
+		return nil, fmt.Errorf("preview size %dx%d too large", size.Width, size.Height)
+	}
+
+	data, err := DecodePackSection(pack)
+	if err != nil {
+		return nil, err
+	}
+	pixels, err := DecompressLZOPack(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(pixels) < size.Width*size.Height*3 {
+		return nil, fmt.Errorf("%w : preview has %d bytes, expect %d", ErrCorruptPack, len(pixels), size.Width*size.Height*3)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, size.Width, size.Height))
+	for y := 0; y < size.Height; y++ {
+		for x := 0; x < size.Width; x++ {
+			i := (y*size.Width + x) * 3
+			img.SetRGBA(x, y, color.RGBA{R: pixels[i], G: pixels[i+1], B: pixels[i+2], A: 0xff})
+		}
+	}
+	return img, nil
+}
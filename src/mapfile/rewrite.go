@@ -0,0 +1,122 @@
+package mapfile
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// 地图里的名字不带扩展名
+func MapNameFromFileName(name string) string {
+	if HasMapExt(name) {
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name
+}
+
+// 改写 [Basic] 的 Name= 和 Author=, nil 表示不改. 其它行原样保留(包括换行符和注释),
+// 原文件不是utf-8时新值也按GB18030编码, 这样老版本的游戏和编辑器还能读
+func SetBasicInfo(data []byte, name, author *string) []byte {
+	values := make(map[string]string)
+	var order []string
+	if name != nil {
+		values["name"] = *name
+		order = append(order, "Name")
+	}
+	if author != nil {
+		values["author"] = *author
+		order = append(order, "Author")
+	}
+	if len(values) == 0 {
+		return data
+	}
+	if !utf8.Valid(data) {
+		for key, value := range values {
+			if encoded, err := simplifiedchinese.GB18030.NewEncoder().String(value); err == nil {
+				values[key] = encoded
+			}
+		}
+	}
+	return setSectionKeys(data, "Basic", order, values)
+}
+
+// 按行改写某个节里的键, 同名的节都会改; 节里没有的键插到第一个同名节的开头.
+// keys 是插入时用的键名和顺序, values 的键是小写的
+func setSectionKeys(data []byte, section string, keys []string, values map[string]string) []byte {
+	newline := []byte("\n")
+	if bytes.Contains(data, []byte("\r\n")) {
+		newline = []byte("\r\n")
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(data) + 64)
+	found := make(map[string]bool)
+	insertAt := -1
+	inSection := false
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			end = len(data) - 1
+		}
+		line := data[:end+1]
+		data = data[end+1:]
+
+		content := bytes.TrimRight(line, "\r\n")
+		trimmed := bytes.TrimSpace(content)
+		if len(trimmed) > 0 && trimmed[0] == '[' {
+			closing := bytes.IndexByte(trimmed, ']')
+			inSection = closing > 0 && strings.EqualFold(string(bytes.TrimSpace(trimmed[1:closing])), section)
+			out.Write(line)
+			if inSection && insertAt < 0 {
+				// 文件最后一行没有换行符时插入前要补上
+				if !bytes.HasSuffix(line, []byte("\n")) {
+					out.Write(newline)
+				}
+				insertAt = out.Len()
+			}
+			continue
+		}
+		if inSection {
+			if eq := bytes.IndexByte(content, '='); eq > 0 {
+				key := strings.ToLower(string(bytes.TrimSpace(content[:eq])))
+				if value, ok := values[key]; ok {
+					found[key] = true
+					out.Write(content[:eq+1])
+					out.WriteString(value)
+					out.Write(line[len(content):])
+					continue
+				}
+			}
+		}
+		out.Write(line)
+	}
+
+	var missing bytes.Buffer
+	for _, key := range keys {
+		if !found[strings.ToLower(key)] {
+			missing.WriteString(key + "=" + values[strings.ToLower(key)])
+			missing.Write(newline)
+		}
+	}
+	if missing.Len() == 0 {
+		return out.Bytes()
+	}
+	result := out.Bytes()
+	if insertAt < 0 {
+		// 没有这个节就加在最后
+		if len(result) > 0 && !bytes.HasSuffix(result, []byte("\n")) {
+			result = append(result, newline...)
+		}
+		result = append(result, "["+section+"]"...)
+		result = append(result, newline...)
+		return append(result, missing.Bytes()...)
+	}
+	var merged bytes.Buffer
+	merged.Write(result[:insertAt])
+	merged.Write(missing.Bytes())
+	merged.Write(result[insertAt:])
+	return merged.Bytes()
+}
@@ -0,0 +1,84 @@
+package mapfile
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// 只改 Name 和 Author 两行, 其它字节原样保留
+func TestSetBasicInfo(t *testing.T) {
+	in := "; header\r\n[Basic]\r\nName = Old ; old\r\nPercent=0\r\n[Map]\r\nSize=0,0,50,50\r\n" +
+		"[basic]\r\nAuthor=someone\r\n[Other]\r\nName=untouched\r\n"
+	want := "; header\r\n[Basic]\r\nName =New Name\r\nPercent=0\r\n[Map]\r\nSize=0,0,50,50\r\n" +
+		"[basic]\r\nAuthor=me\r\n[Other]\r\nName=untouched\r\n"
+	out := SetBasicInfo([]byte(in), strPtr("New Name"), strPtr("me"))
+	if string(out) != want {
+		t.Errorf("got %q\nwant %q", out, want)
+	}
+
+	ini := mustParseINI(t, string(out))
+	if ini.Section("Basic").String("Name", "") != "New Name" || ini.Section("Basic").String("Author", "") != "me" {
+		t.Error("rewritten values not parsed back")
+	}
+	if got := SetBasicInfo([]byte(in), nil, nil); !bytes.Equal(got, []byte(in)) {
+		t.Error("nil values should not change the file")
+	}
+}
+
+// 没有的键插到第一个 [Basic] 开头, 没有 [Basic] 就加在最后
+func TestSetBasicInfoInsert(t *testing.T) {
+	out := SetBasicInfo([]byte("[Basic]\nName=x\n[Map]\nSize=0,0,1,1\n"), nil, strPtr("me"))
+	if string(out) != "[Basic]\nAuthor=me\nName=x\n[Map]\nSize=0,0,1,1\n" {
+		t.Errorf("insert key: %q", out)
+	}
+	out = SetBasicInfo([]byte("[Map]\nSize=0,0,1,1"), strPtr("n"), strPtr("a"))
+	if string(out) != "[Map]\nSize=0,0,1,1\n[Basic]\nName=n\nAuthor=a\n" {
+		t.Errorf("append section: %q", out)
+	}
+	// 最后一行就是 [Basic] 且没有换行符
+	out = SetBasicInfo([]byte("[Map]\r\nSize=0,0,1,1\r\n[Basic]"), strPtr("n"), nil)
+	if string(out) != "[Map]\r\nSize=0,0,1,1\r\n[Basic]\r\nName=n\r\n" {
+		t.Errorf("section at end: %q", out)
+	}
+}
+
+// GBK 的地图写回去仍然是 GBK
+func TestSetBasicInfoGBK(t *testing.T) {
+	encoder := simplifiedchinese.GB18030.NewEncoder()
+	old, err := encoder.String("旧名字")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := SetBasicInfo([]byte("[Basic]\nName="+old+"\nAuthor=x\n"), strPtr("新名字"), nil)
+	want, err := encoder.String("新名字")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("Name="+want+"\n")) {
+		t.Errorf("name not gb18030 encoded: %q", out)
+	}
+	if got := mustParseINI(t, string(out)).Section("Basic").String("Name", ""); got != "新名字" {
+		t.Errorf("parsed name = %q", got)
+	}
+
+	// utf-8 的文件保持 utf-8
+	out = SetBasicInfo([]byte("[Basic]\nName=旧\n"), strPtr("新名字"), nil)
+	if !strings.Contains(string(out), "Name=新名字\n") {
+		t.Errorf("utf-8 file: %q", out)
+	}
+}
+
+func TestMapNameFromFileName(t *testing.T) {
+	for name, want := range map[string]string{"a.yrm": "a", "b.MAP": "b", "c.txt": "c.txt", "d": "d"} {
+		if got := MapNameFromFileName(name); got != want {
+			t.Errorf("MapNameFromFileName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"map-storage-cnb/src/model"
+)
+
+// 限制请求体大小, limit <= 0 表示不限制.
+// 带 Content-Length 的请求在读 body 之前就拒绝, 没有的(chunked 传输)由 MaxBytesReader 读到超限时报错
+func BodyLimit(limit int64, tooLarge model.CommonResp) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if limit <= 0 {
+			ctx.Next()
+			return
+		}
+		if ctx.Request.ContentLength > limit {
+			// 不读 body 直接关连接, 否则 net/http 会把剩下的 body 读完
+			ctx.Header("Connection", "close")
+			ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, tooLarge)
+			return
+		}
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, limit)
+		ctx.Next()
+	}
+}
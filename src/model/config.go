@@ -6,12 +6,19 @@ import (
 )
 
 type ServiceConfig struct {
-	Host string `default:"0.0.0.0"`
-	Port string `default:"8080"`
+	Host                 string `default:"0.0.0.0"`
+	Port                 string `default:"8080"`
+	MaxUploadSize        int64  `default:"52428800"`   // 直传单个文件的上限, 默认50MB, 负数表示不限制(写0会被换成默认值)
+	MaxChunkedUploadSize int64  `default:"1073741824"` // 分块上传整个文件的上限, 默认1GB, 负数表示不限制
+	MaxArchiveSize       int64  `default:"209715200"`  // 压缩包批量导入的上限, 默认200MB, 负数表示不限制
+	UploadTaskTTL        uint   `default:"86400"`      // 秒, 创建之后超过这么久还没合并的分块上传任务会被清理
 }
 
 type LocalStorageConfig struct {
 	Path string `default:"./uploads"`
+	// 按哈希分几层目录, 每层两个字符, 2 是 ab/cd/<hash>, 0 是全部平铺. 改了之后启动时会自动迁移.
+	// 用指针是因为 ParseDefault 会把写明的 0 换成默认值
+	ShardDepth *int `default:"2"`
 }
 
 type GitStorageConfig struct {
@@ -24,6 +31,34 @@ type GitStorageConfig struct {
 	FileBatchWindow     uint   `default:"5"`
 	CommitAuthor        string `default:"RepoBot"`
 	CommitEmail         string `default:"RepoBot@example.com"`
+	LFSEnabled          bool   `default:"false"`   // 大文件以 LFS 指针提交, 内容通过 LFS batch 接口上传
+	LFSThreshold        int64  `default:"1048576"` // 超过这个大小的地图和预览图走 LFS
+	LFSURL              string `default:""`        // 为空时从 http(s) 的 RemoteGitRepoUrl 推算: <repo>.git/info/lfs
+	LFSUsername         string `default:""`
+	LFSPassword         string `default:""` // 密码或者访问令牌, 用 basic auth 发送
+}
+
+type S3StorageConfig struct {
+	Endpoint         string `default:"http://127.0.0.1:9000"` // 带协议, 例如 https://s3.amazonaws.com, MinIO 默认是 http://host:9000
+	Region           string `default:"us-east-1"`
+	Bucket           string `default:"maps"`
+	AccessKeyID      string `default:""` // 为空时匿名访问
+	SecretAccessKey  string `default:""`
+	VirtualHostStyle bool   `default:"false"`    // bucket.endpoint/key, 不开时是 endpoint/bucket/key(MinIO 一般用这种)
+	Prefix           string `default:"maps/"`    // 对象key前缀
+	PartSize         int64  `default:"16777216"` // 超过这个大小分片上传, 也是每片的大小, 不能小于5MB
+	CreateBucket     bool   `default:"false"`    // 启动时桶不存在就创建, 方便本地和测试环境
+}
+
+// 一个主存储加若干副本, 写主存储之后异步复制到副本, 读按 ReadOrder 依次尝试.
+// 主存储用 DB.URL, 每个副本有自己的db, 文件名是 DB.URL 加上存储类型, 例如 data.GitStorage.db
+type ReplicatedStorageConfig struct {
+	Primary       string `default:"LocalStorage"` // 存储类型
+	Replicas      string `default:"GitStorage"`   // 逗号分隔的存储类型
+	ReadOrder     string `default:""`             // 逗号分隔, 为空时先主存储再按 Replicas 的顺序
+	SyncWorkers   uint   `default:"2"`
+	RetryInterval uint   `default:"60"` // 秒, 定时重试还没同步成功的副本
+	MaxAttempts   uint   `default:"10"` // 超过次数的失败副本不再自动重试
 }
 
 type StorageDBConfig struct {
@@ -33,10 +68,12 @@ type StorageDBConfig struct {
 }
 
 type StorageConfig struct {
-	Type         StorageType        `default:"LocalStorage"`
-	DB           StorageDBConfig    `default:""`
-	GitStorage   GitStorageConfig   `default:""`
-	LocalStorage LocalStorageConfig `default:""`
+	Type         string                  `default:"LocalStorage"` // 存储类型, 用 string 是因为 ParseDefault 给自定义类型填默认值会 panic
+	DB           StorageDBConfig         `default:""`
+	GitStorage   GitStorageConfig        `default:""`
+	LocalStorage LocalStorageConfig      `default:""`
+	S3Storage    S3StorageConfig         `default:""`
+	Replicated   ReplicatedStorageConfig `default:""`
 }
 
 type Config struct {
@@ -0,0 +1,12 @@
+package model
+
+import (
+	"map-storage-cnb/src/mapfile"
+)
+
+// 两个版本之间的差异, From -> To
+type MapDiffResponse struct {
+	From     string                `json:"from"`
+	To       string                `json:"to"`
+	Sections []mapfile.SectionDiff `json:"sections"`
+}
@@ -1,31 +1,112 @@
 package model
 
-import "time"
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	MaxNameLength    = 255
+	MaxAuthorsLength = 512
+	MaxMessageLength = 4096
+)
 
 type MapStorageStatus uint
 type StorageType string
 
+// 地图对应的游戏, 和 mapfile.Game 一致
+type MapType string
+
+const (
+	MapTypeRA2 MapType = "ra2"
+	MapTypeYR  MapType = "yr"
+)
+
 const (
 	MapUploadStatusSuccess MapStorageStatus = iota
 	MapUploadStatusOnProgress
 	MapUploadStatusFailed
+	MapDeleteStatusOnProgress // 删除已受理, 还没推送到远端
+	MapDeleteStatusFailed
 )
 
 const (
 	MapUploadStatusMsgSuccess    = "success"
 	MapUploadStatusMsgOnProgress = "on progress"
 	MapUploadStatusMsgUnknown    = "unknown failed"
+	MapDeleteStatusMsgOnProgress = "delete on progress"
+)
+
+// 存储进度, git 存储会依次经过 queued -> written -> committed -> pushed,
+// 同步存储直接是 stored, 任何一步失败都是 failed
+type MapStorageStage string
+
+const (
+	MapStageQueued    MapStorageStage = "queued"
+	MapStageWritten   MapStorageStage = "written"
+	MapStageCommitted MapStorageStage = "committed"
+	MapStagePushed    MapStorageStage = "pushed"
+	MapStageStored    MapStorageStage = "stored"
+	MapStageFailed    MapStorageStage = "failed"
 )
 
+// 之后不会再有新的状态变化
+func (s MapStorageStage) IsFinal() bool {
+	return s == MapStagePushed || s == MapStageStored || s == MapStageFailed
+}
+
+// 存储状态变化事件, 查询状态和 SSE 推送共用
+type MapStatusEvent struct {
+	Hash    string           `json:"hash"`
+	Stage   MapStorageStage  `json:"stage"`
+	Status  MapStorageStatus `json:"status"`
+	Reason  string           `json:"reason"`
+	Deleted bool             `json:"deleted,omitempty"` // 删除操作的事件
+	Time    int64            `json:"time"`              // UnixNano
+}
+
+// 只有db里的状态时推算出来的进度
+func (m *MapMetaData) StatusEvent() MapStatusEvent {
+	event := MapStatusEvent{
+		Hash:    m.Hash,
+		Status:  m.StorageStatus,
+		Reason:  m.StorageStatusMsg,
+		Deleted: m.StorageStatus == MapDeleteStatusOnProgress || m.StorageStatus == MapDeleteStatusFailed,
+		Time:    time.Now().UnixNano(),
+	}
+	switch m.StorageStatus {
+	case MapUploadStatusSuccess:
+		event.Stage = MapStageStored
+	case MapUploadStatusOnProgress, MapDeleteStatusOnProgress:
+		event.Stage = MapStageQueued
+	default:
+		event.Stage = MapStageFailed
+	}
+	return event
+}
+
 // 地图元数据,理论上都可以从地图本身计算和获取的到
 type MapMetaData struct {
-	Hash             string `gorm:"primaryKey"` // SHA-256 hex
-	Name             string
-	Size             uint64
-	CreateTime       int64  // UnixNano，方便列举排序
-	PrevHash         string // 指向上一个版本，首版留空
-	Message          string // 提交备注
-	Authors          string
+	Hash            string `gorm:"primaryKey"` // SHA-256 hex
+	CanonicalHash   string `gorm:"index"`      // 规范化之后的 SHA-256, 见 mapfile.CanonicalHash
+	Name            string
+	Size            uint64
+	CreateTime      int64  // UnixNano，方便列举排序
+	PrevHash        string // 指向上一个版本，首版留空
+	Message         string // 提交备注
+	Authors         string
+	MapType         MapType // 类型检测之前上传的地图为空
+	GameMode        string  `gorm:"index"` // 小写逗号分隔的模式列表, 例如 standard,meatgrind
+	MinPlayer       int     `gorm:"index"`
+	MaxPlayer       int     `gorm:"index"`
+	MultiplayerOnly bool    `gorm:"index"`
+	Mission         bool    `gorm:"index"` // 单人任务
+	// 上面几个分类字段是否已经从地图文件里解析过, 单人任务的 MaxPlayer 本来就是0, 不能用它判断
+	Classified       bool `gorm:"index;default:false" json:"-"`
 	StorageType      StorageType
 	StorageStatus    MapStorageStatus
 	StorageStatusMsg string
@@ -74,21 +155,143 @@ func (m *MapMetaData) SetStorageStatus(statusType MapStorageStatus, reason strin
 		m.StorageStatus = MapUploadStatusFailed
 		m.StorageStatusMsg = reason
 
+	case MapDeleteStatusOnProgress:
+		m.StorageStatus = MapDeleteStatusOnProgress
+		m.StorageStatusMsg = MapDeleteStatusMsgOnProgress
+
+	case MapDeleteStatusFailed:
+		m.StorageStatus = MapDeleteStatusFailed
+		m.StorageStatusMsg = reason
+
+	}
+
+}
+
+// 副本的同步状态
+type ReplicaStatus string
+
+const (
+	ReplicaStatusPending ReplicaStatus = "pending" // 等待复制, 或者主存储/副本还在异步处理中
+	ReplicaStatusSynced  ReplicaStatus = "synced"
+	ReplicaStatusFailed  ReplicaStatus = "failed"
+)
+
+// 复合存储里一张地图在一个副本上的同步状态, 主存储删掉地图并同步到副本之后这条记录也会删掉
+type MapReplica struct {
+	Hash       string        `gorm:"primaryKey" json:"hash"`
+	Backend    StorageType   `gorm:"primaryKey" json:"backend"`
+	Status     ReplicaStatus `gorm:"index" json:"status"`
+	Msg        string        `json:"msg"`
+	Attempts   uint          `json:"attempts"`    // 连续失败次数, 成功后清零
+	UpdateTime int64         `json:"update_time"` // UnixNano
+}
+
+// 从某个版本沿 PrevHash 往前的版本链, 链不完整时也返回已经找到的部分
+type MapHistory struct {
+	Versions   []MapMetaData `json:"versions"`
+	BrokenLink string        `json:"broken_link,omitempty"` // 链上找不到的 PrevHash
+	CycleAt    string        `json:"cycle_at,omitempty"`    // 成环时重复出现的 hash
+	Truncated  bool          `json:"truncated"`             // 达到 limit 时还有更早的版本
+}
+
+// 名字会被存储拿来当文件名, 去掉首尾空白并拒绝路径分隔符和控制字符
+func NormalizeName(raw string) (string, error) {
+	name := strings.TrimSpace(raw)
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid name %q", raw)
+	}
+	if len(name) > MaxNameLength {
+		return "", fmt.Errorf("name longer than %d bytes", MaxNameLength)
+	}
+	if strings.ContainsAny(name, `/\`) || strings.ContainsFunc(name, unicode.IsControl) {
+		return "", fmt.Errorf("name %q contains path separator or control character", name)
+	}
+	return name, nil
+}
+
+// 可以由用户修改的元数据, nil 表示不修改, 空字符串表示清空.
+// Hash, Size, StorageStatus 之类由存储维护的字段不在这里
+type MapMetaDataUpdate struct {
+	Name     *string `json:"name"`
+	Message  *string `json:"message"`
+	Authors  *string `json:"authors"`
+	PrevHash *string `json:"prev_hash"`
+}
+
+// 校验并规范化输入, hash 是被修改的地图
+func (u *MapMetaDataUpdate) Validate(hash string) error {
+	if u.Name == nil && u.Message == nil && u.Authors == nil && u.PrevHash == nil {
+		return errors.New("nothing to update")
+	}
+	if u.Name != nil {
+		name, err := NormalizeName(*u.Name)
+		if err != nil {
+			return err
+		}
+		u.Name = &name
+	}
+	if u.Authors != nil {
+		if len(*u.Authors) > MaxAuthorsLength {
+			return fmt.Errorf("authors longer than %d bytes", MaxAuthorsLength)
+		}
+		// 会被写进地图的 Author= , 换行能注入新的节
+		if strings.ContainsFunc(*u.Authors, unicode.IsControl) {
+			return fmt.Errorf("authors %q contains control character", *u.Authors)
+		}
+	}
+	if u.Message != nil && len(*u.Message) > MaxMessageLength {
+		return fmt.Errorf("message longer than %d bytes", MaxMessageLength)
 	}
+	if u.PrevHash != nil && *u.PrevHash != "" {
+		prevHash := strings.ToLower(strings.TrimSpace(*u.PrevHash))
+		if _, err := hex.DecodeString(prevHash); err != nil || len(prevHash) != 64 {
+			return fmt.Errorf("prev_hash %q is not a sha256 hex string", *u.PrevHash)
+		}
+		if prevHash == hash {
+			return errors.New("prev_hash can not point to itself")
+		}
+		u.PrevHash = &prevHash
+	}
+	return nil
+}
 
+// 转成 gorm 的 Updates 参数, 只包含需要修改的列
+func (u *MapMetaDataUpdate) Columns() map[string]any {
+	columns := make(map[string]any)
+	if u.Name != nil {
+		columns["name"] = *u.Name
+	}
+	if u.Message != nil {
+		columns["message"] = *u.Message
+	}
+	if u.Authors != nil {
+		columns["authors"] = *u.Authors
+	}
+	if u.PrevHash != nil {
+		columns["prev_hash"] = *u.PrevHash
+	}
+	return columns
 }
 
-// TODO 查询用
+// 组合查询条件, nil 表示不参与过滤, 时间是 UnixNano
 type MapMetaDataSearch struct {
-	Hash      *string
-	Name      *string
-	MinSize   *uint64
-	MaxSize   *uint64
-	StartTime *int64 // 时间区间
-	EndTime   *int64
-	PrevHash  *string
-	Message   *string
-	Authors   *string // 英文半角逗号做分隔符,不用字符串列表是因为sqlite不支持
-	OrderDesc bool
-	Limit     uint
+	Hash            *string `form:"hash"`
+	Name            *string `form:"name"` // 模糊匹配
+	MinSize         *uint64 `form:"min_size"`
+	MaxSize         *uint64 `form:"max_size"`
+	StartTime       *int64  `form:"start_time"` // 时间区间
+	EndTime         *int64  `form:"end_time"`
+	PrevHash        *string `form:"prev_hash"`
+	Message         *string `form:"message"` // 模糊匹配
+	Authors         *string `form:"authors"` // 英文半角逗号做分隔符,不用字符串列表是因为sqlite不支持, 每个作者都要匹配上
+	MapType         *string `form:"map_type"`
+	CanonicalHash   *string `form:"canonical_hash"`
+	GameMode        *string `form:"game_mode"`  // 英文半角逗号做分隔符, 每个模式都要支持
+	Players         *int    `form:"players"`    // 支持这个人数的地图, 即 min_player <= players <= max_player
+	MinPlayer       *int    `form:"min_player"` // 人数区间, 支持其中任意人数的地图都算, 即 max_player >= min_player
+	MaxPlayer       *int    `form:"max_player"` // 即 min_player <= max_player
+	MultiplayerOnly *bool   `form:"multiplayer_only"`
+	Mission         *bool   `form:"mission"`
+	OrderDesc       bool    `form:"order_desc"`
+	Limit           uint    `form:"limit"`
 }
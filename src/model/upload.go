@@ -6,11 +6,105 @@ import (
 
 type UploadFileRequest struct {
 	File     *multipart.FileHeader `form:"file" binding:"required"`
-	Filename string                `form:"filename"`
+	Filename string                `form:"filename"` // 空的话用地图里的名字, 再没有就用上传的文件名
 	Sha256   string                `form:"sha256"`
+	Authors  string                `form:"authors"` // 空的话用地图里的作者
+	Message  string                `form:"message"`
 }
 
 type UploadFileResponse struct {
 	Size   uint64 `json:"size"`
 	Sha256 string `json:"sha256"`
 }
+
+// 413 时附带的提示
+type UploadTooLargeResponse struct {
+	MaxSize          int64  `json:"max_size"`
+	ChunkedUploadURL string `json:"chunked_upload_url,omitempty"` // 直传超限时提示改用分块上传
+}
+
+// 分块上传初始化, chunk size 和 chunks 由前端决定, 后端只负责校验
+type UploadInitRequest struct {
+	Filename  string `form:"filename" json:"filename" binding:"required"`
+	Size      uint64 `form:"size" json:"size" binding:"required"`
+	ChunkSize uint64 `form:"chunk_size" json:"chunk_size" binding:"required"`
+	Chunks    uint   `form:"chunks" json:"chunks" binding:"required"`
+	Sha256    string `form:"sha256" json:"sha256"` // 整个文件的sha256, 可空, 合并时校验
+	Authors   string `form:"authors" json:"authors"`
+	Message   string `form:"message" json:"message"`
+}
+
+type UploadInitResponse struct {
+	TaskID    string `json:"task_id"`
+	ChunkSize uint64 `json:"chunk_size"`
+	Chunks    uint   `json:"chunks"`
+}
+
+type UploadChunkRequest struct {
+	TaskID string                `form:"task_id" binding:"required"`
+	Index  *uint                 `form:"index" binding:"required"` // 从0开始, 用指针是因为0也是合法值
+	Chunk  *multipart.FileHeader `form:"chunk" binding:"required"`
+	Sha256 string                `form:"sha256"` // 单个分块的sha256, 可空, 不一致时只需重传该分块
+}
+
+type UploadChunkResponse struct {
+	TaskID   string `json:"task_id"`
+	Index    uint   `json:"index"`
+	Received uint   `json:"received"`
+	Chunks   uint   `json:"chunks"`
+}
+
+type UploadMergeRequest struct {
+	TaskID string `form:"task_id" json:"task_id" binding:"required"`
+}
+
+// 存在 ./tmp/{task_id}/metadata.json 里的任务元数据
+type UploadTaskMeta struct {
+	TaskID     string `json:"task_id"`
+	Filename   string `json:"filename"`
+	Size       uint64 `json:"size"`
+	ChunkSize  uint64 `json:"chunk_size"`
+	Chunks     uint   `json:"chunks"`
+	Sha256     string `json:"sha256"`
+	Authors    string `json:"authors"`
+	Message    string `json:"message"`
+	CreateTime int64  `json:"create_time"`
+}
+
+// 第index个分块应有的大小, 只有最后一块可以比 ChunkSize 小
+func (t *UploadTaskMeta) ChunkLength(index uint) uint64 {
+	if index+1 < t.Chunks {
+		return t.ChunkSize
+	}
+	return t.Size - uint64(t.Chunks-1)*t.ChunkSize
+}
+
+// 压缩包(zip 或 mix)批量导入, message 会写到每张地图上
+type UploadArchiveRequest struct {
+	File    *multipart.FileHeader `form:"file" binding:"required"`
+	Message string                `form:"message"`
+}
+
+type ArchiveEntryStatus string
+
+const (
+	ArchiveEntryStored    ArchiveEntryStatus = "stored"
+	ArchiveEntryDuplicate ArchiveEntryStatus = "duplicate"
+	ArchiveEntryRejected  ArchiveEntryStatus = "rejected"
+)
+
+// 压缩包里每个文件的处理结果
+type ArchiveEntryResult struct {
+	Entry  string             `json:"entry"` // 压缩包里的路径, mix里没有名字的是8位十六进制的文件ID
+	Status ArchiveEntryStatus `json:"status"`
+	Reason string             `json:"reason,omitempty"`
+	Name   string             `json:"name,omitempty"`
+	Sha256 string             `json:"sha256,omitempty"` // 重复时是已有地图的sha256
+}
+
+type UploadArchiveResponse struct {
+	Stored    int                  `json:"stored"`
+	Duplicate int                  `json:"duplicate"`
+	Rejected  int                  `json:"rejected"`
+	Entries   []ArchiveEntryResult `json:"entries"`
+}
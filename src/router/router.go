@@ -1,43 +1,81 @@
 package router
 
 import (
-	"fmt"
+	"context"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"map-storage-cnb/src/middleware"
 	"map-storage-cnb/src/model"
 	"map-storage-cnb/src/service"
 	"map-storage-cnb/src/storage"
 )
 
 func InitStorage(cfg model.StorageConfig) (*storage.Interface, error) {
-	var storageService storage.Interface
-	switch cfg.Type {
-	case storage.StorageTypeLocalStorage:
-		storageService = storage.NewLocalStorage()
-	case storage.StorageTypeGitStorage:
-		storageService = storage.NewGitStorage()
-	default:
-		return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+	storageService, err := storage.New(model.StorageType(cfg.Type))
+	if err != nil {
+		return nil, err
 	}
 
-	storageService.Init(cfg)
+	if err := storageService.Init(cfg); err != nil {
+		return nil, err
+	}
 
 	return &storageService, nil
 }
-func RegisterAll(engine *gin.Engine, cfg model.StorageConfig) error {
+func RegisterAll(engine *gin.Engine, cfg *model.Config) error {
 
-	storage, err := InitStorage(cfg)
+	storageService, err := InitStorage(cfg.Storage)
 	if err != nil {
 		return err
 	}
 
 	uploadAPI := &service.UploadAPI{
-		Storage: *storage,
+		Storage: *storageService,
+		Cfg:     cfg.Service,
+	}
+	go storage.BackfillClassification(context.Background(), *storageService, service.ClassifyMap)
+	go service.SweepUploadTasks(time.Duration(cfg.Service.UploadTaskTTL) * time.Second)
+	mapAPI := &service.MapAPI{
+		Storage: *storageService,
 	}
 
 	v1 := engine.Group("/api/v1")
-	v1.POST("/upload", uploadAPI.MapUploadApi)
+	directLimit := middleware.BodyLimit(
+		formBodyLimit(cfg.Service.MaxUploadSize), service.UploadTooLarge(cfg.Service.MaxUploadSize))
+	archiveLimit := middleware.BodyLimit(
+		formBodyLimit(cfg.Service.MaxArchiveSize), service.TooLarge(cfg.Service.MaxArchiveSize))
+	chunkLimit := middleware.BodyLimit(
+		service.MaxChunkSize+service.FormOverhead, service.TooLarge(service.MaxChunkSize))
+
+	v1.POST("/upload", directLimit, uploadAPI.MapUploadApi)
+	v1.POST("/upload/init", uploadAPI.UploadInitApi)
+	v1.POST("/upload/chunk", chunkLimit, uploadAPI.UploadChunkApi)
+	v1.POST("/upload/merge", uploadAPI.UploadMergeApi)
+	v1.POST("/upload/archive", archiveLimit, uploadAPI.UploadArchiveApi)
+
+	maps := v1.Group("/maps")
+	maps.GET("", mapAPI.MapSearchApi)
+	maps.GET("/:hash/file", mapAPI.MapDownloadApi)
+	maps.HEAD("/:hash/file", mapAPI.MapDownloadApi)
+	maps.GET("/:hash/preview", mapAPI.MapPreviewApi)
+	maps.GET("/:hash/minimap", mapAPI.MapMinimapApi)
+	maps.PUT("/:hash", mapAPI.MapUpdateApi)
+	maps.DELETE("/:hash", mapAPI.MapDeleteApi)
+	maps.GET("/:hash/history", mapAPI.MapHistoryApi)
+	maps.GET("/:hash/diff/:otherHash", mapAPI.MapDiffApi)
+	maps.GET("/:hash/status", mapAPI.MapStatusApi)
+	maps.GET("/:hash/status/stream", mapAPI.MapStatusStreamApi)
+	maps.GET("/:hash/replicas", mapAPI.MapReplicasApi)
 
 	return nil
 }
+
+// 文件上限加上表单余量就是请求体上限. 配置里负数表示不限制, 原样交给 BodyLimit, 不能加上表单余量
+func formBodyLimit(maxFileSize int64) int64 {
+	if maxFileSize <= 0 {
+		return maxFileSize
+	}
+	return maxFileSize + service.FormOverhead
+}
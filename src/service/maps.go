@@ -0,0 +1,335 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"map-storage-cnb/src/mapfile"
+	"map-storage-cnb/src/model"
+	"map-storage-cnb/src/storage"
+)
+
+type MapAPI struct {
+	Storage storage.Interface
+}
+
+// 存储层的错误对应的http状态码
+func storageErrorCode(err error) int {
+	if errors.Is(err, storage.ErrMapNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// If-None-Match 用弱比较, 支持 "*" 和逗号分隔的多个etag
+func etagMatch(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// 组合条件查询元数据, 参数见 model.MapMetaDataSearch
+func (m *MapAPI) MapSearchApi(ctx *gin.Context) {
+	var search model.MapMetaDataSearch
+	if err := ctx.ShouldBindQuery(&search); err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : "+err.Error()))
+		return
+	}
+	if search.Hash != nil {
+		hash := strings.ToLower(*search.Hash)
+		search.Hash = &hash
+	}
+	if search.PrevHash != nil {
+		prevHash := strings.ToLower(*search.PrevHash)
+		search.PrevHash = &prevHash
+	}
+
+	result, err := m.Storage.SearchMeta(ctx, search)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, model.Fail(err.Error()))
+		return
+	}
+	ctx.JSON(http.StatusOK, model.OK(result))
+}
+
+// 下载地图文件, sha256 本身就是强etag.
+// Range 只支持单个区间, 同样从存储流式读取, 跳过区间前面的字节, 读够就停
+func (m *MapAPI) MapDownloadApi(ctx *gin.Context) {
+	hash := strings.ToLower(ctx.Param("hash"))
+	meta, err := m.Storage.GetMeta(ctx, hash)
+	if err != nil {
+		ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+		return
+	}
+
+	etag := `"` + meta.Hash + `"`
+	if inm := ctx.GetHeader("If-None-Match"); inm != "" && etagMatch(inm, etag) {
+		ctx.Header("ETag", etag)
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+
+	size := int64(meta.Size)
+	writer := &downloadWriter{ctx: ctx, status: http.StatusOK, remain: size}
+	// If-Range 对不上时忽略 Range, 返回整个文件
+	rangeHeader := ctx.GetHeader("Range")
+	if ifRange := ctx.GetHeader("If-Range"); ifRange != "" && ifRange != etag {
+		rangeHeader = ""
+	}
+	if rangeHeader != "" {
+		start, length, ok, err := parseByteRange(rangeHeader, size)
+		if err != nil {
+			ctx.Header("Content-Range", fmt.Sprintf("bytes */%d", size))
+			ctx.JSON(http.StatusRequestedRangeNotSatisfiable, model.Fail(err.Error()))
+			return
+		}
+		if ok {
+			writer.status = http.StatusPartialContent
+			writer.skip = start
+			writer.remain = length
+			ctx.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		}
+	}
+	// 头在第一次写数据时才发出去, 存储读失败还能返回不带附件头的json错误
+	writer.header = func() {
+		ctx.Header("ETag", etag)
+		ctx.Header("Accept-Ranges", "bytes")
+		ctx.Header("Content-Type", "application/octet-stream")
+		ctx.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": meta.Name}))
+		ctx.Header("Content-Length", strconv.FormatInt(writer.remain, 10))
+	}
+	if ctx.Request.Method == http.MethodHead {
+		writer.begin()
+		return
+	}
+
+	_, err = m.Storage.Get(ctx, hash, writer)
+	if err != nil && !errors.Is(err, errDownloadDone) {
+		log.Printf("download %s error : %v", hash, err)
+		if !writer.started {
+			ctx.Writer.Header().Del("Content-Range")
+			ctx.JSON(storageErrorCode(err), model.Fail("read map failed : "+err.Error()))
+		}
+		return
+	}
+	// 空文件不会触发写
+	writer.begin()
+}
+
+var (
+	errDownloadDone        = errors.New("download done")
+	errRangeNotSatisfiable = errors.New("range not satisfiable")
+)
+
+// 解析单个区间 bytes=a-b, bytes=a-, bytes=-n. 多个区间或格式不对时 ok 为 false, 按整个文件处理
+func parseByteRange(header string, size int64) (start int64, length int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+	if first == "" {
+		// 最后 n 个字节
+		n, parseErr := strconv.ParseInt(last, 10, 64)
+		if parseErr != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return size - n, n, true, nil
+	}
+	start, parseErr := strconv.ParseInt(first, 10, 64)
+	if parseErr != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, parseErr = strconv.ParseInt(last, 10, 64)
+		if parseErr != nil || end < start {
+			return 0, 0, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, end - start + 1, true, nil
+}
+
+// 存储写数据时才发出响应头. 区间下载先丢掉 skip 个字节, 写满 remain 个字节后
+// 返回 errDownloadDone 让存储停止读取
+type downloadWriter struct {
+	ctx     *gin.Context
+	header  func()
+	status  int
+	skip    int64
+	remain  int64
+	started bool
+}
+
+func (w *downloadWriter) begin() {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.header()
+	w.ctx.Status(w.status)
+	w.ctx.Writer.WriteHeaderNow()
+}
+
+func (w *downloadWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.skip >= int64(n) {
+		w.skip -= int64(n)
+		return n, nil
+	}
+	p = p[w.skip:]
+	w.skip = 0
+	if int64(len(p)) > w.remain {
+		p = p[:w.remain]
+	}
+	if len(p) > 0 {
+		w.begin()
+		written, err := w.ctx.Writer.Write(p)
+		w.remain -= int64(written)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if w.remain == 0 {
+		return n, errDownloadDone
+	}
+	return n, nil
+}
+
+// 修改元数据, 只接受 MapMetaDataUpdate 里的字段, 带上其它字段(例如size)直接拒绝.
+// ?rewrite_file=true 时名字和作者会写回地图文件, 作为新版本保存
+func (m *MapAPI) MapUpdateApi(ctx *gin.Context) {
+	hash := strings.ToLower(ctx.Param("hash"))
+	rewriteFile, err := strconv.ParseBool(ctx.DefaultQuery("rewrite_file", "false"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : rewrite_file must be a bool"))
+		return
+	}
+
+	var update model.MapMetaDataUpdate
+	decoder := json.NewDecoder(ctx.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&update); err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail("invalid params, only name, message, authors and prev_hash can be updated : "+err.Error()))
+		return
+	}
+	if err := update.Validate(hash); err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : "+err.Error()))
+		return
+	}
+	if rewriteFile {
+		if update.PrevHash != nil {
+			ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : prev_hash can not be set with rewrite_file, the new version always points to this one"))
+			return
+		}
+		if update.Name == nil && update.Authors == nil {
+			ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : rewrite_file needs name or authors"))
+			return
+		}
+		// 地图里 ; 后面是注释, 写进去会被截断
+		if (update.Name != nil && strings.Contains(*update.Name, ";")) || (update.Authors != nil && strings.Contains(*update.Authors, ";")) {
+			ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : name and authors can not contain ';' with rewrite_file"))
+			return
+		}
+	}
+	if update.Name != nil {
+		meta, err := m.Storage.GetMeta(ctx, hash)
+		if err != nil {
+			ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+			return
+		}
+		// 改名不能改掉地图类型对应的扩展名
+		if meta.MapType != "" {
+			name, err := model.NormalizeName(mapfile.WithExt(*update.Name, mapfile.Game(meta.MapType), filepath.Ext(meta.Name)))
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : "+err.Error()))
+				return
+			}
+			update.Name = &name
+		}
+	}
+	if rewriteFile {
+		m.rewriteMapFile(ctx, hash, update)
+		return
+	}
+	m.updateMeta(ctx, hash, update)
+}
+
+// 只改db和存储里的元数据, 不动地图文件
+func (m *MapAPI) updateMeta(ctx *gin.Context, hash string, update model.MapMetaDataUpdate) {
+	if update.PrevHash != nil && *update.PrevHash != "" {
+		exist, err := m.Storage.Exists(ctx, *update.PrevHash)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, model.Fail(err.Error()))
+			return
+		}
+		if !exist {
+			ctx.JSON(http.StatusBadRequest, model.Fail("prev_hash not found : "+*update.PrevHash))
+			return
+		}
+	}
+
+	meta, err := m.Storage.Update(ctx, hash, update)
+	if err != nil {
+		ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+		return
+	}
+	ctx.JSON(http.StatusOK, model.OK(meta))
+}
+
+// 删除地图. 存储是异步删除的(例如git要等推送), 返回 202 和当前的元数据, 之后可以查状态
+func (m *MapAPI) MapDeleteApi(ctx *gin.Context) {
+	hash := strings.ToLower(ctx.Param("hash"))
+	if err := m.Storage.Delete(ctx, hash); err != nil {
+		ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+		return
+	}
+
+	meta, err := m.Storage.GetMeta(ctx, hash)
+	if err == nil {
+		ctx.JSON(http.StatusAccepted, model.OK(meta))
+		return
+	}
+	ctx.JSON(http.StatusOK, model.OK(nil))
+}
+
+// 历史版本, limit 可选
+func (m *MapAPI) MapHistoryApi(ctx *gin.Context) {
+	hash := strings.ToLower(ctx.Param("hash"))
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "0"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : "+err.Error()))
+		return
+	}
+
+	history, err := m.Storage.GetHistory(ctx, hash, limit)
+	if err != nil {
+		ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+		return
+	}
+	ctx.JSON(http.StatusOK, model.OK(history))
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"map-storage-cnb/src/mapfile"
+	"map-storage-cnb/src/model"
+)
+
+// 读出整张地图
+func (m *MapAPI) loadMapFile(ctx *gin.Context, hash string) (*model.MapMetaData, []byte, error) {
+	var buf bytes.Buffer
+	meta, err := m.Storage.Get(ctx, hash, &buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, buf.Bytes(), nil
+}
+
+// 读出整张地图并解析
+func (m *MapAPI) loadMapINI(ctx *gin.Context, hash string) (*model.MapMetaData, *mapfile.INI, error) {
+	meta, data, err := m.loadMapFile(ctx, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	ini, err := mapfile.ParseINI(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, ini, nil
+}
+
+// 从 :hash 到 :otherHash 的节级别差异, 默认返回json, ?format=unified 返回统一diff格式的文本
+func (m *MapAPI) MapDiffApi(ctx *gin.Context) {
+	hash := strings.ToLower(ctx.Param("hash"))
+	otherHash := strings.ToLower(ctx.Param("otherHash"))
+	format := ctx.DefaultQuery("format", "json")
+	if format != "json" && format != "unified" {
+		ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : format must be json or unified"))
+		return
+	}
+
+	fromMeta, from, err := m.loadMapINI(ctx, hash)
+	if err != nil {
+		ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+		return
+	}
+	toMeta, to, err := m.loadMapINI(ctx, otherHash)
+	if err != nil {
+		ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+		return
+	}
+
+	diffs := mapfile.Diff(from, to)
+	if format == "unified" {
+		var buf bytes.Buffer
+		if err := mapfile.WriteUnified(&buf, fromMeta.Name, toMeta.Name, diffs); err != nil {
+			ctx.JSON(http.StatusInternalServerError, model.Fail(err.Error()))
+			return
+		}
+		ctx.Data(http.StatusOK, "text/x-diff; charset=utf-8", buf.Bytes())
+		return
+	}
+	if diffs == nil {
+		diffs = []mapfile.SectionDiff{}
+	}
+	ctx.JSON(http.StatusOK, model.OK(&model.MapDiffResponse{From: hash, To: otherHash, Sections: diffs}))
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"map-storage-cnb/src/mapfile"
+	"map-storage-cnb/src/model"
+	"map-storage-cnb/src/storage"
+)
+
+const (
+	placeholderWidth  = 200
+	placeholderHeight = 150
+)
+
+// 没有预览图的地图统一返回的占位图, 灰底加一圈边框
+var placeholderPreview = sync.OnceValue(func() []byte {
+	background := color.RGBA{R: 0x30, G: 0x30, B: 0x30, A: 0xff}
+	border := color.RGBA{R: 0x60, G: 0x60, B: 0x60, A: 0xff}
+	img := image.NewRGBA(image.Rect(0, 0, placeholderWidth, placeholderHeight))
+	for y := 0; y < placeholderHeight; y++ {
+		for x := 0; x < placeholderWidth; x++ {
+			c := background
+			if x < 2 || y < 2 || x >= placeholderWidth-2 || y >= placeholderHeight-2 {
+				c = border
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+})
+
+// 预览图, 地图里没有预览图时返回占位图并带上 X-Preview-Placeholder
+func (m *MapAPI) MapPreviewApi(ctx *gin.Context) {
+	hash := strings.ToLower(ctx.Param("hash"))
+
+	var buf bytes.Buffer
+	err := m.Storage.GetPreview(ctx, hash, &buf)
+	if errors.Is(err, storage.ErrPreviewNotFound) {
+		ctx.Header("X-Preview-Placeholder", "true")
+		ctx.Data(http.StatusOK, "image/png", placeholderPreview())
+		return
+	}
+	if err != nil {
+		ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+		return
+	}
+
+	// 预览图跟着地图内容走, 地图哈希不变它就不会变
+	etag := `"` + hash + `-preview"`
+	ctx.Header("ETag", etag)
+	if inm := ctx.GetHeader("If-None-Match"); inm != "" && etagMatch(inm, etag) {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+	ctx.Data(http.StatusOK, "image/png", buf.Bytes())
+}
+
+// 从地形和覆盖物渲染的小地图, 不依赖地图自带的预览图. 每次请求现算
+func (m *MapAPI) MapMinimapApi(ctx *gin.Context) {
+	hash := strings.ToLower(ctx.Param("hash"))
+	etag := `"` + hash + `-minimap"`
+	if inm := ctx.GetHeader("If-None-Match"); inm != "" && etagMatch(inm, etag) {
+		if exist, err := m.Storage.Exists(ctx, hash); err == nil && exist {
+			ctx.Header("ETag", etag)
+			ctx.Status(http.StatusNotModified)
+			return
+		}
+	}
+
+	_, ini, err := m.loadMapINI(ctx, hash)
+	if err != nil {
+		ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+		return
+	}
+	img, err := mapfile.Minimap(ini)
+	if err != nil {
+		ctx.JSON(http.StatusUnprocessableEntity, model.Fail("render minimap failed : "+err.Error()))
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		ctx.JSON(http.StatusInternalServerError, model.Fail(err.Error()))
+		return
+	}
+	ctx.Header("ETag", etag)
+	ctx.Data(http.StatusOK, "image/png", buf.Bytes())
+}
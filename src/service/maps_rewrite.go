@@ -0,0 +1,74 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"map-storage-cnb/src/mapfile"
+	"map-storage-cnb/src/model"
+	"map-storage-cnb/src/storage"
+)
+
+// 把名字和作者写回 [Basic] 的 Name= Author=, 改过的文件作为新版本保存, PrevHash 指向原来的版本.
+// 原来的版本不动. 文件里本来就是这些值时退回到只改元数据
+func (m *MapAPI) rewriteMapFile(ctx *gin.Context, hash string, update model.MapMetaDataUpdate) {
+	meta, data, err := m.loadMapFile(ctx, hash)
+	if err != nil {
+		ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+		return
+	}
+
+	var mapName *string
+	var changed []string
+	if update.Name != nil {
+		name := mapfile.MapNameFromFileName(*update.Name)
+		mapName = &name
+		changed = append(changed, "Name")
+	}
+	if update.Authors != nil {
+		changed = append(changed, "Author")
+	}
+	rewritten := mapfile.SetBasicInfo(data, mapName, update.Authors)
+	sum := sha256.Sum256(rewritten)
+	newHash := hex.EncodeToString(sum[:])
+	if newHash == meta.Hash {
+		m.updateMeta(ctx, hash, update)
+		return
+	}
+
+	newMeta := model.NewMetaData(newHash, meta.Name)
+	newMeta.Authors = meta.Authors
+	newMeta.Message = fmt.Sprintf("update %s in map file", strings.Join(changed, " and "))
+	newMeta.PrevHash = meta.Hash
+	if update.Name != nil {
+		newMeta.Name = *update.Name
+	}
+	if update.Authors != nil {
+		newMeta.Authors = *update.Authors
+	}
+	if update.Message != nil {
+		newMeta.Message = *update.Message
+	}
+	if err := fillMetaFromMap(&newMeta, newMeta.Name, bytes.NewReader(rewritten)); err != nil {
+		mapParseError(ctx, err)
+		return
+	}
+
+	saved, err := m.Storage.Save(ctx, newMeta, bytes.NewReader(rewritten))
+	if err != nil {
+		if errors.Is(err, storage.ErrMapExists) {
+			ctx.JSON(http.StatusConflict, model.FailWithData(err.Error(), saved))
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, model.Fail(err.Error()))
+		return
+	}
+	ctx.JSON(http.StatusOK, model.OK(saved))
+}
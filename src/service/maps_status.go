@@ -0,0 +1,109 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"map-storage-cnb/src/model"
+	"map-storage-cnb/src/storage"
+)
+
+const statusKeepAlive = 15 * time.Second
+
+// 当前状态, 处理中的地图优先用存储内存里的最新进度, 否则由db里的状态推算
+func (m *MapAPI) currentStatus(ctx *gin.Context, hash string) (model.MapStatusEvent, error) {
+	if notifier, ok := m.Storage.(storage.StatusNotifier); ok {
+		if event, ok := notifier.LatestStatus(hash); ok {
+			return event, nil
+		}
+	}
+	meta, err := m.Storage.GetMeta(ctx, hash)
+	if err != nil {
+		return model.MapStatusEvent{}, err
+	}
+	return meta.StatusEvent(), nil
+}
+
+// 轮询存储状态
+func (m *MapAPI) MapStatusApi(ctx *gin.Context) {
+	hash := strings.ToLower(ctx.Param("hash"))
+	event, err := m.currentStatus(ctx, hash)
+	if err != nil {
+		ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+		return
+	}
+	ctx.JSON(http.StatusOK, model.OK(event))
+}
+
+// 用 SSE 推送存储状态变化, 先推一次当前状态, 到达最终状态(pushed/stored/failed)后关闭
+func (m *MapAPI) MapStatusStreamApi(ctx *gin.Context) {
+	hash := strings.ToLower(ctx.Param("hash"))
+
+	// 先订阅再查当前状态, 中间发生的变化不会漏掉
+	var events <-chan model.MapStatusEvent
+	if notifier, ok := m.Storage.(storage.StatusNotifier); ok {
+		var cancel func()
+		events, cancel = notifier.SubscribeStatus(hash)
+		defer cancel()
+	}
+
+	event, err := m.currentStatus(ctx, hash)
+	if err != nil {
+		ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+		return
+	}
+	ctx.SSEvent("status", event)
+	ctx.Writer.Flush()
+	if events == nil || event.Stage.IsFinal() {
+		return
+	}
+
+	keepAlive := time.NewTicker(statusKeepAlive)
+	defer keepAlive.Stop()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// 订阅跟不上被关掉了, 补发一次当前状态
+				if event, err := m.currentStatus(ctx, hash); err == nil {
+					ctx.SSEvent("status", event)
+				}
+				return false
+			}
+			ctx.SSEvent("status", event)
+			return !event.Stage.IsFinal()
+		case <-keepAlive.C:
+			ctx.SSEvent("ping", time.Now().UnixNano())
+			return true
+		case <-ctx.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// 每个副本的同步状态, 只有带副本的存储支持
+func (m *MapAPI) MapReplicasApi(ctx *gin.Context) {
+	hash := strings.ToLower(ctx.Param("hash"))
+	reporter, ok := m.Storage.(storage.ReplicaReporter)
+	if !ok {
+		ctx.JSON(http.StatusNotImplemented, model.Fail("storage has no replicas"))
+		return
+	}
+	replicas, err := reporter.ReplicaStatus(ctx, hash)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, model.Fail(err.Error()))
+		return
+	}
+	// 副本也删完了的地图不会有记录
+	if len(replicas) == 0 {
+		if _, err := m.Storage.GetMeta(ctx, hash); err != nil {
+			ctx.JSON(storageErrorCode(err), model.Fail(err.Error()))
+			return
+		}
+	}
+	ctx.JSON(http.StatusOK, model.OK(replicas))
+}
@@ -1,23 +1,50 @@
 package service
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"path/filepath"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 
+	"map-storage-cnb/src/mapfile"
 	"map-storage-cnb/src/model"
 	"map-storage-cnb/src/storage"
-
-	"map-storage-cnb/src/utils"
 )
 
 const (
-	MaxFormMem = 32 << 20 // 32 MB 内存表单阈值
+	MaxFormMem   = 32 << 20 // 32 MB 内存表单阈值
+	FormOverhead = 64 << 10 // multipart 边界和其它表单字段的余量, 请求体上限 = 文件上限 + FormOverhead
+
+	ChunkedUploadURL = "/api/v1/upload/init"
 )
 
 type UploadAPI struct {
 	Storage storage.Interface
+	Cfg     model.ServiceConfig
+}
+
+// 直传超限的响应, 提示改用分块上传
+func UploadTooLarge(maxSize int64) model.CommonResp {
+	return model.FailWithData(
+		fmt.Sprintf("file larger than %d bytes, use chunked upload instead", maxSize),
+		&model.UploadTooLargeResponse{MaxSize: maxSize, ChunkedUploadURL: ChunkedUploadURL})
+}
+
+// 分块上传的分块或整个文件, 以及压缩包超限的响应
+func TooLarge(maxSize int64) model.CommonResp {
+	return model.FailWithData(
+		fmt.Sprintf("larger than %d bytes", maxSize),
+		&model.UploadTooLargeResponse{MaxSize: maxSize})
+}
+
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
 }
 
 func (u *UploadAPI) MapUploadApi(ctx *gin.Context) {
@@ -26,9 +53,17 @@ func (u *UploadAPI) MapUploadApi(ctx *gin.Context) {
 	var request model.UploadFileRequest
 	err := ctx.ShouldBind(&request)
 	if err != nil {
+		if isBodyTooLarge(err) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, UploadTooLarge(u.Cfg.MaxUploadSize))
+			return
+		}
 		ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : "+err.Error()))
 		return
 	}
+	if u.Cfg.MaxUploadSize > 0 && request.File.Size > u.Cfg.MaxUploadSize {
+		ctx.JSON(http.StatusRequestEntityTooLarge, UploadTooLarge(u.Cfg.MaxUploadSize))
+		return
+	}
 
 	hash := request.Sha256
 	if hash != "" {
@@ -39,11 +74,6 @@ func (u *UploadAPI) MapUploadApi(ctx *gin.Context) {
 		}
 
 	}
-	fileSize := request.File.Size
-	filename := request.Filename
-	if filename == "" {
-		filename = request.File.Filename
-	}
 	file, err := request.File.Open()
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, model.Fail("open file failed : "+err.Error()))
@@ -51,30 +81,112 @@ func (u *UploadAPI) MapUploadApi(ctx *gin.Context) {
 	}
 	defer file.Close()
 
-	fileData, err := io.ReadAll(file)
-	if err != nil {
+	mapMetaData := model.NewMetaData(hash, request.Filename)
+	mapMetaData.Authors = request.Authors
+	mapMetaData.Message = request.Message
+	if err := fillMetaFromMap(&mapMetaData, request.File.Filename, file); err != nil {
+		mapParseError(ctx, err)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
 		ctx.JSON(http.StatusInternalServerError, model.Fail("read file failed : "+err.Error()))
 		return
 	}
-	hash = utils.HashFile(fileData)
+	u.saveMap(ctx, mapMetaData, file)
+}
 
-	meta, _ := u.Storage.GetMeta(ctx, hash)
-	if meta != nil {
-		ctx.JSON(http.StatusConflict, model.FailWithData(request.Filename+" already uploaded", meta))
-		return
+// 解析地图并识别类型, 客户端没填的元数据用地图里的补全, 名字的扩展名按类型修正.
+// uploadName 是上传的文件名, 地图里的名字不能用时拿它兜底. 不是地图返回 mapfile.ErrNotMap
+func fillMetaFromMap(meta *model.MapMetaData, uploadName string, reader io.Reader) error {
+	ini, err := mapfile.ParseINI(reader)
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("%w : %v", mapfile.ErrNotMap, err)
 	}
+	if err != nil {
+		return err
+	}
+	mapType, err := mapfile.Detect(ini)
+	if err != nil {
+		return err
+	}
+	info, err := mapfile.ReadInfo(ini)
+	if err != nil {
+		return err
+	}
+
+	name := meta.Name
+	if name == "" && info.Name != "" {
+		if normalized, err := model.NormalizeName(info.Name + filepath.Ext(uploadName)); err == nil {
+			name = normalized
+		}
+	}
+	if name == "" {
+		name = uploadName
+	}
+	meta.Name = mapfile.WithExt(name, mapType.Game, mapType.Ext())
+	meta.MapType = model.MapType(mapType.Game)
+	meta.CanonicalHash = mapfile.CanonicalHash(ini)
+	classify(meta, info)
+	if meta.Authors == "" && len(info.Author) <= model.MaxAuthorsLength {
+		meta.Authors = info.Author
+	}
+	return nil
+}
 
-	mapMetaData := model.NewMetaData(hash, filename)
-	mapMetaData.Size = uint64(fileSize)
+func classify(meta *model.MapMetaData, info *mapfile.MapInfo) {
+	meta.GameMode = strings.Join(info.GameModes, ",")
+	meta.MinPlayer = info.MinPlayers
+	meta.MaxPlayer = info.MaxPlayers
+	meta.MultiplayerOnly = info.MultiplayerOnly
+	meta.Mission = info.Mission
+	meta.Classified = true
+}
 
-	_, err = u.Storage.Save(ctx, mapMetaData, fileData)
+// 重新解析已经存了的地图, 只更新分类字段, 给 storage.BackfillClassification 用
+func ClassifyMap(meta *model.MapMetaData, reader io.Reader) error {
+	ini, err := mapfile.ParseINI(reader)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, model.Fail(err.Error()))
+		return err
+	}
+	info, err := mapfile.ReadInfo(ini)
+	if err != nil {
+		return err
+	}
+	classify(meta, info)
+	return nil
+}
+
+// 地图解析失败时的响应, 不是地图是 422
+func mapParseError(ctx *gin.Context, err error) {
+	if errors.Is(err, mapfile.ErrNotMap) {
+		ctx.JSON(http.StatusUnprocessableEntity, model.Fail(err.Error()))
 		return
 	}
+	ctx.JSON(http.StatusInternalServerError, model.Fail("read map failed : "+err.Error()))
+}
+
+// 写入存储, 直传和分块合并共用, 响应也在这里写.
+// 哈希校验和查重交给存储, 失败时把存储返回的错误原样返回
+func (u *UploadAPI) saveMap(ctx *gin.Context, mapMetaData model.MapMetaData, reader io.Reader) error {
+	meta, err := u.Storage.Save(ctx, mapMetaData, reader)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrMapDuplicate):
+			ctx.JSON(http.StatusConflict, model.FailWithData(
+				fmt.Sprintf("%s is the same map as already uploaded %s", mapMetaData.Name, meta.Hash), meta))
+		case errors.Is(err, storage.ErrMapExists):
+			ctx.JSON(http.StatusConflict, model.FailWithData(mapMetaData.Name+" already uploaded", meta))
+		case errors.Is(err, storage.ErrHashMismatch):
+			ctx.JSON(http.StatusBadRequest, model.Fail(err.Error()))
+		default:
+			ctx.JSON(http.StatusInternalServerError, model.Fail(err.Error()))
+		}
+		return err
+	}
 
 	ctx.JSON(http.StatusOK, model.OK(&model.UploadFileResponse{
-		Sha256: hash,
-		Size:   uint64(fileSize),
+		Sha256: meta.Hash,
+		Size:   meta.Size,
 	}))
+	return nil
 }
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"map-storage-cnb/src/config"
+	"map-storage-cnb/src/mapfile"
+	"map-storage-cnb/src/model"
+	"map-storage-cnb/src/storage"
+)
+
+const MaxArchiveEntries = 1000
+
+var archiveSpoolDir = filepath.Join(config.UploadTmpDir, "archive_spool")
+
+type saveFunc func(ctx context.Context, metaData model.MapMetaData, reader io.Reader) (*model.MapMetaData, error)
+
+// 压缩包里的一个文件, zip 和 mix 共用
+type archiveEntry struct {
+	name string
+	size uint64
+	open func() (io.ReadCloser, error)
+	// zip 按扩展名筛选, mix 里的文件经常没有名字, 只能看内容
+	checkExt bool
+}
+
+// zip 里没有设置utf-8标记的文件名一般是GBK
+func zipEntries(archive *zip.Reader) []archiveEntry {
+	var entries []archiveEntry
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		name := file.Name
+		if file.NonUTF8 {
+			name = mapfile.DecodeText([]byte(file.Name))
+		}
+		entries = append(entries, archiveEntry{
+			name:     name,
+			size:     file.UncompressedSize64,
+			open:     file.Open,
+			checkExt: true,
+		})
+	}
+	return entries
+}
+
+// 没有文件名列表的mix, 文件用ID表示
+func mixEntries(mix *mapfile.Mix) []archiveEntry {
+	var entries []archiveEntry
+	for _, entry := range mix.Entries {
+		entries = append(entries, archiveEntry{
+			name: entry.DisplayName(),
+			size: uint64(entry.Size),
+			open: func() (io.ReadCloser, error) { return io.NopCloser(mix.Open(entry)), nil },
+		})
+	}
+	return entries
+}
+
+// 先按zip打开, 不是zip再试mix
+func openArchive(file io.ReaderAt, size int64) ([]archiveEntry, error) {
+	zipReader, zipErr := zip.NewReader(file, size)
+	if zipErr == nil {
+		return zipEntries(zipReader), nil
+	}
+	mix, mixErr := mapfile.OpenMix(file, size)
+	if mixErr == nil {
+		return mixEntries(mix), nil
+	}
+	return nil, fmt.Errorf("not a zip or mix archive : %v; %v", zipErr, mixErr)
+}
+
+// 从压缩包(zip 或西木的 mix)批量导入地图. 不是地图的文件和重复的地图跳过, 返回每个文件的处理结果.
+// 支持批量提交的存储(例如git)整个压缩包只提交一次
+func (u *UploadAPI) UploadArchiveApi(ctx *gin.Context) {
+	var request model.UploadArchiveRequest
+	err := ctx.ShouldBind(&request)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, TooLarge(u.Cfg.MaxArchiveSize))
+			return
+		}
+		ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : "+err.Error()))
+		return
+	}
+	if u.Cfg.MaxArchiveSize > 0 && request.File.Size > u.Cfg.MaxArchiveSize {
+		ctx.JSON(http.StatusRequestEntityTooLarge, TooLarge(u.Cfg.MaxArchiveSize))
+		return
+	}
+
+	file, err := request.File.Open()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail("open file failed : "+err.Error()))
+		return
+	}
+	defer file.Close()
+
+	entries, err := openArchive(file, request.File.Size)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail(err.Error()))
+		return
+	}
+	if len(entries) > MaxArchiveEntries {
+		ctx.JSON(http.StatusBadRequest, model.Fail(fmt.Sprintf("archive must not contain more than %d entries", MaxArchiveEntries)))
+		return
+	}
+
+	save := saveFunc(u.Storage.Save)
+	if saver, ok := u.Storage.(storage.BatchSaver); ok {
+		batch := saver.NewBatch()
+		defer batch.Commit()
+		save = batch.Save
+	}
+
+	response := &model.UploadArchiveResponse{Entries: []model.ArchiveEntryResult{}}
+	for _, entry := range entries {
+		result := u.importArchiveEntry(ctx, save, entry, request.Message)
+		switch result.Status {
+		case model.ArchiveEntryStored:
+			response.Stored++
+		case model.ArchiveEntryDuplicate:
+			response.Duplicate++
+		case model.ArchiveEntryRejected:
+			response.Rejected++
+		}
+		response.Entries = append(response.Entries, result)
+	}
+	ctx.JSON(http.StatusOK, model.OK(response))
+}
+
+// 导入压缩包里的一个文件, 单个文件的大小限制和直传一样
+func (u *UploadAPI) importArchiveEntry(ctx context.Context, save saveFunc, entry archiveEntry, message string) model.ArchiveEntryResult {
+	result := model.ArchiveEntryResult{Entry: entry.name, Status: model.ArchiveEntryRejected}
+	reject := func(reason string) model.ArchiveEntryResult {
+		result.Reason = reason
+		return result
+	}
+
+	name := path.Base(strings.ReplaceAll(entry.name, "\\", "/"))
+	if entry.checkExt && !mapfile.HasMapExt(name) {
+		return reject("not a map file")
+	}
+	maxSize := u.Cfg.MaxUploadSize
+	if maxSize > 0 && entry.size > uint64(maxSize) {
+		return reject(fmt.Sprintf("larger than %d bytes", maxSize))
+	}
+
+	reader, err := entry.open()
+	if err != nil {
+		return reject("open entry failed : " + err.Error())
+	}
+	defer reader.Close()
+	// 压缩包里记录的大小不可信, 实际读的时候再限制一次
+	var limited io.Reader = reader
+	if maxSize > 0 {
+		limited = io.LimitReader(reader, maxSize+1)
+	}
+	// 先落盘, 不把整个文件读进内存
+	spooled, err := storage.SpoolToTemp(archiveSpoolDir, limited)
+	if err != nil {
+		return reject("read entry failed : " + err.Error())
+	}
+	defer os.Remove(spooled.Path)
+	if maxSize > 0 && spooled.Size > uint64(maxSize) {
+		return reject(fmt.Sprintf("larger than %d bytes", maxSize))
+	}
+	file, err := os.Open(spooled.Path)
+	if err != nil {
+		return reject("read entry failed : " + err.Error())
+	}
+	defer file.Close()
+
+	hash := spooled.Hash
+	metaData := model.NewMetaData(hash, "")
+	metaData.Message = message
+	if err := fillMetaFromMap(&metaData, name, file); err != nil {
+		return reject(err.Error())
+	}
+	result.Name = metaData.Name
+
+	if exist, _ := u.Storage.Exists(ctx, hash); exist {
+		result.Status = model.ArchiveEntryDuplicate
+		result.Sha256 = hash
+		return result
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return reject("read entry failed : " + err.Error())
+	}
+	meta, err := save(ctx, metaData, file)
+	if err != nil {
+		if errors.Is(err, storage.ErrMapExists) && meta != nil {
+			result.Status = model.ArchiveEntryDuplicate
+			result.Sha256 = meta.Hash
+			result.Reason = err.Error()
+			return result
+		}
+		return reject(err.Error())
+	}
+	result.Status = model.ArchiveEntryStored
+	result.Sha256 = meta.Hash
+	return result
+}
@@ -1,8 +1,396 @@
 package service
 
-import "sync"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"map-storage-cnb/src/config"
+	"map-storage-cnb/src/mapfile"
+	"map-storage-cnb/src/model"
+	"map-storage-cnb/src/storage"
+	"map-storage-cnb/src/utils"
+)
+
+const (
+	MinChunkSize = 1 << 20  // 1 MB, 只有一块的任务不受限制
+	MaxChunkSize = 16 << 20 // 16 MB, 需要小于 MaxFormMem
+	MaxChunks    = 10000
+
+	taskMetaFileName = "metadata.json"
+)
 
 var (
 	// 合并锁，防止并发同时写同一目标
 	mergeLock sync.Map
+	// 任务锁, 分块上传拿读锁可以并发, 合并和过期清理拿写锁
+	taskLocks sync.Map
 )
+
+func taskLock(taskID string) *sync.RWMutex {
+	lock, _ := taskLocks.LoadOrStore(taskID, &sync.RWMutex{})
+	return lock.(*sync.RWMutex)
+}
+
+// 删除任务目录, 调用方需要持有任务写锁
+func removeTask(taskID string) {
+	os.RemoveAll(taskDir(taskID))
+	taskLocks.Delete(taskID)
+}
+
+func taskDir(taskID string) string {
+	return filepath.Join(config.UploadTmpDir, taskID)
+}
+
+func chunkPath(dir string, index uint) string {
+	return filepath.Join(dir, fmt.Sprintf("%d.chunk", index))
+}
+
+// task id 会拼进路径, 必须是合法的uuid
+func parseTaskID(raw string) (string, error) {
+	id, err := uuid.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid task id %q", raw)
+	}
+	return id.String(), nil
+}
+
+func loadTaskMeta(taskID string) (*model.UploadTaskMeta, error) {
+	data, err := os.ReadFile(filepath.Join(taskDir(taskID), taskMetaFileName))
+	if err != nil {
+		return nil, err
+	}
+	var meta model.UploadTaskMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func writeTaskMeta(meta *model.UploadTaskMeta) error {
+	data, err := json.MarshalIndent(meta, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(taskDir(meta.TaskID), taskMetaFileName), data, 0644)
+}
+
+// 还没收到的分块下标
+func missingChunks(dir string, meta *model.UploadTaskMeta) []uint {
+	var missing []uint
+	for i := uint(0); i < meta.Chunks; i++ {
+		if !utils.FileExists(chunkPath(dir, i)) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// 按顺序读出所有分块, 一次只打开一个文件
+type chunkReader struct {
+	dir     string
+	chunks  uint
+	index   uint
+	current *os.File
+}
+
+func newChunkReader(dir string, meta *model.UploadTaskMeta) *chunkReader {
+	return &chunkReader{dir: dir, chunks: meta.Chunks}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.index >= r.chunks {
+				return 0, io.EOF
+			}
+			file, err := os.Open(chunkPath(r.dir, r.index))
+			if err != nil {
+				return 0, err
+			}
+			r.current = file
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			r.index++
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+// 定时清理客户端放弃了的分块上传任务, 按任务目录的修改时间算过期, 每收到一个分块都会刷新.
+// 临时目录下还有存储的落盘目录, 只处理名字是 uuid 的任务目录
+func SweepUploadTasks(ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	interval := min(ttl, time.Hour)
+	for {
+		sweepUploadTasks(ttl)
+		time.Sleep(interval)
+	}
+}
+
+func sweepUploadTasks(ttl time.Duration) {
+	entries, err := os.ReadDir(config.UploadTmpDir)
+	if err != nil {
+		log.Printf("sweep upload tasks failed : %v", err)
+		return
+	}
+	deadline := time.Now().Add(-ttl)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		taskID, err := parseTaskID(entry.Name())
+		if err != nil || taskID != entry.Name() {
+			continue
+		}
+		// 正在传分块或者合并的任务不动, 拿到锁之后再看时间
+		lock := taskLock(taskID)
+		if !lock.TryLock() {
+			continue
+		}
+		info, err := os.Stat(taskDir(taskID))
+		if err == nil && info.ModTime().Before(deadline) {
+			log.Printf("remove expired upload task %s", taskID)
+			removeTask(taskID)
+		}
+		lock.Unlock()
+	}
+}
+
+func (u *UploadAPI) UploadInitApi(ctx *gin.Context) {
+	var request model.UploadInitRequest
+	err := ctx.ShouldBind(&request)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : "+err.Error()))
+		return
+	}
+
+	if u.Cfg.MaxChunkedUploadSize > 0 && request.Size > uint64(u.Cfg.MaxChunkedUploadSize) {
+		ctx.JSON(http.StatusRequestEntityTooLarge, TooLarge(u.Cfg.MaxChunkedUploadSize))
+		return
+	}
+	if request.ChunkSize > MaxChunkSize || (request.Chunks > 1 && request.ChunkSize < MinChunkSize) {
+		ctx.JSON(http.StatusBadRequest, model.Fail(fmt.Sprintf(
+			"chunk_size must between %d and %d", MinChunkSize, MaxChunkSize)))
+		return
+	}
+	if request.Chunks > MaxChunks {
+		ctx.JSON(http.StatusBadRequest, model.Fail(fmt.Sprintf("chunks must not exceed %d", MaxChunks)))
+		return
+	}
+	// 不限制大小时 size 可以很大, 向上取整不能用加法, 会溢出
+	expectChunks := request.Size / request.ChunkSize
+	if request.Size%request.ChunkSize != 0 {
+		expectChunks++
+	}
+	if uint64(request.Chunks) != expectChunks {
+		ctx.JSON(http.StatusBadRequest, model.Fail(fmt.Sprintf(
+			"chunks %d does not match size and chunk_size, expect %d", request.Chunks, expectChunks)))
+		return
+	}
+
+	if request.Sha256 != "" {
+		exist, _ := u.Storage.Exists(ctx, request.Sha256)
+		if exist {
+			ctx.JSON(http.StatusConflict, model.Fail(request.Filename+" already uploaded"))
+			return
+		}
+	}
+
+	meta := &model.UploadTaskMeta{
+		TaskID:     uuid.NewString(),
+		Filename:   request.Filename,
+		Size:       request.Size,
+		ChunkSize:  request.ChunkSize,
+		Chunks:     request.Chunks,
+		Sha256:     strings.ToLower(request.Sha256),
+		Authors:    request.Authors,
+		Message:    request.Message,
+		CreateTime: time.Now().UnixNano(),
+	}
+	if err := os.MkdirAll(taskDir(meta.TaskID), 0755); err != nil {
+		ctx.JSON(http.StatusInternalServerError, model.Fail("create task dir failed : "+err.Error()))
+		return
+	}
+	if err := writeTaskMeta(meta); err != nil {
+		os.RemoveAll(taskDir(meta.TaskID))
+		ctx.JSON(http.StatusInternalServerError, model.Fail("write task metadata failed : "+err.Error()))
+		return
+	}
+
+	ctx.JSON(http.StatusOK, model.OK(&model.UploadInitResponse{
+		TaskID:    meta.TaskID,
+		ChunkSize: meta.ChunkSize,
+		Chunks:    meta.Chunks,
+	}))
+}
+
+// 同一个分块可以重复上传, 后到的覆盖先到的, 断线之后只需重传失败的分块
+func (u *UploadAPI) UploadChunkApi(ctx *gin.Context) {
+	var request model.UploadChunkRequest
+	err := ctx.ShouldBind(&request)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, TooLarge(MaxChunkSize))
+			return
+		}
+		ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : "+err.Error()))
+		return
+	}
+	taskID, err := parseTaskID(request.TaskID)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail(err.Error()))
+		return
+	}
+	lock := taskLock(taskID)
+	lock.RLock()
+	defer lock.RUnlock()
+	meta, err := loadTaskMeta(taskID)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, model.Fail("upload task not found : "+taskID))
+		return
+	}
+
+	index := *request.Index
+	if index >= meta.Chunks {
+		ctx.JSON(http.StatusBadRequest, model.Fail(fmt.Sprintf("chunk index %d out of range [0, %d)", index, meta.Chunks)))
+		return
+	}
+	if uint64(request.Chunk.Size) != meta.ChunkLength(index) {
+		ctx.JSON(http.StatusBadRequest, model.Fail(fmt.Sprintf(
+			"chunk %d size %d mismatch, expect %d", index, request.Chunk.Size, meta.ChunkLength(index))))
+		return
+	}
+
+	file, err := request.Chunk.Open()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail("open chunk failed : "+err.Error()))
+		return
+	}
+	defer file.Close()
+
+	// 先写临时文件再改名, 写一半断掉的分块不会被当成已收到
+	dir := taskDir(taskID)
+	tmp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, model.Fail("create chunk failed : "+err.Error()))
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), file)
+	tmp.Close()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, model.Fail("write chunk failed : "+err.Error()))
+		return
+	}
+	if request.Sha256 != "" && !strings.EqualFold(request.Sha256, hex.EncodeToString(hasher.Sum(nil))) {
+		ctx.JSON(http.StatusBadRequest, model.Fail(fmt.Sprintf("chunk %d sha256 mismatch", index)))
+		return
+	}
+	if err := os.Rename(tmp.Name(), chunkPath(dir, index)); err != nil {
+		ctx.JSON(http.StatusInternalServerError, model.Fail("write chunk failed : "+err.Error()))
+		return
+	}
+	// 刷新目录时间, 还在传的任务不会被当成过期
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+
+	ctx.JSON(http.StatusOK, model.OK(&model.UploadChunkResponse{
+		TaskID:   taskID,
+		Index:    index,
+		Received: meta.Chunks - uint(len(missingChunks(dir, meta))),
+		Chunks:   meta.Chunks,
+	}))
+}
+
+func (u *UploadAPI) UploadMergeApi(ctx *gin.Context) {
+	var request model.UploadMergeRequest
+	err := ctx.ShouldBind(&request)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail("invalid params : "+err.Error()))
+		return
+	}
+	taskID, err := parseTaskID(request.TaskID)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, model.Fail(err.Error()))
+		return
+	}
+
+	if _, loaded := mergeLock.LoadOrStore(taskID, struct{}{}); loaded {
+		ctx.JSON(http.StatusConflict, model.Fail("upload task "+taskID+" is merging"))
+		return
+	}
+	defer mergeLock.Delete(taskID)
+	// 等正在写的分块写完
+	lock := taskLock(taskID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	meta, err := loadTaskMeta(taskID)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, model.Fail("upload task not found : "+taskID))
+		return
+	}
+	dir := taskDir(taskID)
+	if missing := missingChunks(dir, meta); len(missing) > 0 {
+		ctx.JSON(http.StatusBadRequest, model.FailWithData("chunks missing", missing))
+		return
+	}
+
+	mapMetaData := model.NewMetaData(meta.Sha256, meta.Filename)
+	mapMetaData.Authors = meta.Authors
+	mapMetaData.Message = meta.Message
+	parseReader := newChunkReader(dir, meta)
+	err = fillMetaFromMap(&mapMetaData, meta.Filename, parseReader)
+	parseReader.Close()
+	if err != nil {
+		mapParseError(ctx, err)
+		// 不是地图的任务重试也没用, 直接作废
+		if errors.Is(err, mapfile.ErrNotMap) {
+			removeTask(taskID)
+		}
+		return
+	}
+
+	// 分块直接按顺序流给存储, 哈希校验由存储完成
+	reader := newChunkReader(dir, meta)
+	defer reader.Close()
+
+	err = u.saveMap(ctx, mapMetaData, reader)
+	// 存储本身失败时保留分块, 客户端可以直接重试合并; 哈希对不上说明分块有损坏, 任务作废
+	if err != nil && !errors.Is(err, storage.ErrMapExists) && !errors.Is(err, storage.ErrHashMismatch) {
+		return
+	}
+	removeTask(taskID)
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	mapConfig "map-storage-cnb/src/config"
+	"map-storage-cnb/src/model"
+)
+
+const classifyPageSize = 100
+
+var classifySpoolDir = filepath.Join(mapConfig.UploadTmpDir, "classify_spool")
+
+// 加上分类字段之前存的地图没有游戏模式和人数, 启动时把文件取出来重新解析补上.
+// 解析过的地图标记成 classified, 包括人数是0的单人任务和解析失败的文件, 下次启动不再取
+func BackfillClassification(ctx context.Context, s Interface, classify func(meta *model.MapMetaData, reader io.Reader) error) {
+	holder, ok := s.(metaDBHolder)
+	if !ok {
+		return
+	}
+	db := holder.metaDB()
+	if err := os.MkdirAll(classifySpoolDir, 0755); err != nil {
+		log.Printf("backfill classification failed : %v", err)
+		return
+	}
+
+	updated := 0
+	after := ""
+	for {
+		metas, err := db.ListUnclassified(ctx, after, classifyPageSize)
+		if err != nil {
+			log.Printf("backfill classification failed : %v", err)
+			return
+		}
+		for i := range metas {
+			meta := &metas[i]
+			after = meta.Hash
+			if err := classifyStored(ctx, s, meta, classify); err != nil {
+				log.Printf("classify %s failed : %v", meta.Hash, err)
+				continue
+			}
+			if err := db.UpdateClassification(ctx, meta); err != nil {
+				log.Printf("classify %s failed : %v", meta.Hash, err)
+				continue
+			}
+			updated++
+		}
+		if len(metas) < classifyPageSize {
+			break
+		}
+	}
+	if updated > 0 {
+		log.Printf("backfilled classification for %d maps", updated)
+	}
+}
+
+// 地图可能很大, 先取到临时文件里再解析. 取文件失败返回错误, 下次启动再试;
+// 文件本身解析不了的重试也没用, 只记日志
+func classifyStored(ctx context.Context, s Interface, meta *model.MapMetaData, classify func(meta *model.MapMetaData, reader io.Reader) error) error {
+	tmp, err := os.CreateTemp(classifySpoolDir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := s.Get(ctx, meta.Hash, tmp); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := classify(meta, tmp); err != nil {
+		log.Printf("parse %s failed, skip classification : %v", meta.Hash, err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"map-storage-cnb/src/model"
+)
+
+func newTestLocalStorage(t *testing.T) *LocalStorage {
+	t.Chdir(t.TempDir())
+	var cfg model.StorageConfig
+	cfg.DB.URL = filepath.Join(t.TempDir(), "data.db")
+	cfg.LocalStorage.Path = "store"
+	s := NewLocalStorage()
+	if err := s.Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// 人数是0的单人任务和解析不了的文件分类一次之后不再取文件
+func TestBackfillClassificationOnce(t *testing.T) {
+	s := newTestLocalStorage(t)
+	ctx := context.Background()
+	contents := map[string][]byte{
+		"mission.map":  randomBytes(t, 64),
+		"skirmish.mpr": randomBytes(t, 64),
+		"broken.map":   randomBytes(t, 64),
+	}
+	for name, data := range contents {
+		if _, err := s.Save(ctx, model.NewMetaData(sha256Hex(data), name), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	calls := 0
+	classify := func(meta *model.MapMetaData, reader io.Reader) error {
+		calls++
+		switch meta.Name {
+		case "skirmish.mpr":
+			meta.GameMode, meta.MinPlayer, meta.MaxPlayer = "standard", 2, 4
+		case "mission.map":
+			meta.Mission = true
+		default:
+			return errors.New("not a map")
+		}
+		meta.Classified = true
+		return nil
+	}
+	BackfillClassification(ctx, s, classify)
+	if calls != 3 {
+		t.Fatalf("first run classified %d maps, want 3", calls)
+	}
+	BackfillClassification(ctx, s, classify)
+	if calls != 3 {
+		t.Errorf("second run fetched %d maps again", calls-3)
+	}
+
+	skirmish, err := s.DB.Get(ctx, sha256Hex(contents["skirmish.mpr"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skirmish.MaxPlayer != 4 || skirmish.GameMode != "standard" || !skirmish.Classified {
+		t.Errorf("skirmish = %+v", skirmish)
+	}
+	mission, err := s.DB.Get(ctx, sha256Hex(contents["mission.map"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mission.Mission || !mission.Classified {
+		t.Errorf("mission = %+v", mission)
+	}
+}
+
+// 取文件失败的下次再试
+func TestBackfillClassificationRetryMissingFile(t *testing.T) {
+	s := newTestLocalStorage(t)
+	ctx := context.Background()
+	meta := model.NewMetaData(sha256Hex([]byte("gone")), "gone.map")
+	if err := s.DB.Add(ctx, meta); err != nil {
+		t.Fatal(err)
+	}
+	BackfillClassification(ctx, s, func(*model.MapMetaData, io.Reader) error { return nil })
+	metas, err := s.DB.ListUnclassified(ctx, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 {
+		t.Errorf("unclassified = %d, want 1", len(metas))
+	}
+}
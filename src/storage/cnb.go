@@ -11,42 +11,84 @@ import (
 	"sync"
 	"time"
 
+	mapConfig "map-storage-cnb/src/config"
 	"map-storage-cnb/src/model"
 	"map-storage-cnb/src/utils"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"golang.org/x/sync/errgroup"
-	"gorm.io/gorm"
 )
 
 const (
 	StorageTypeGitStorage model.StorageType = "GitStorage"
 )
 
+// 等待写入工作区的上传文件, 不能放在工作区里, 否则会被 AddGlob 一起提交
+var gitSpoolDir = filepath.Join(mapConfig.UploadTmpDir, "git_spool")
+
+type FileOp uint
+
+const (
+	FileOpWrite  FileOp = iota // 新地图, 内容已经落在 TmpPath 上, 写入工作区时直接移动过去
+	FileOpMeta                 // 只改元数据, 名字变了的话顺便移动地图文件
+	FileOpDelete               // 从仓库里删掉地图文件和元数据文件
+	FileOpBatch                // Batch 里的写入作为一个整体进入同一个提交, 见 NewBatch
+)
+
+// 等待提交的文件
 type FileObj struct {
-	Name    string
-	Hash    string
-	Content []byte
+	Op             FileOp
+	Name           string
+	Hash           string
+	TmpPath        string
+	PreviewTmpPath string             // 预览图的临时文件, 地图没有预览图时为空
+	OldName        string             // FileOpMeta 修改前的名字
+	Meta           *model.MapMetaData // 写进仓库元数据文件的内容, 删除时是删除前的元数据
+	Batch          []FileObj          // FileOpBatch 包含的写入
 }
 
+// 推送流水线里每个文件的状态, 每到一个阶段发一次到 StorageFileMetaChan
 type StorageFileMeta struct {
+	Op       FileOp
 	Filename string
 	Hash     string
+	Stage    model.MapStorageStage
 	Status   model.MapStorageStatus
 	Reason   string
 }
 
+func (f StorageFileMeta) failed() bool {
+	return f.Status == model.MapUploadStatusFailed || f.Status == model.MapDeleteStatusFailed
+}
+
+func (f StorageFileMeta) statusEvent() model.MapStatusEvent {
+	return model.MapStatusEvent{
+		Hash:    f.Hash,
+		Stage:   f.Stage,
+		Status:  f.Status,
+		Reason:  f.Reason,
+		Deleted: f.Op == FileOpDelete,
+		Time:    time.Now().UnixNano(),
+	}
+}
+
 type GitStorage struct {
 	cfg                 model.GitStorageConfig
 	DB                  *StorageDB
 	ctx                 context.Context
 	ctxCancel           context.CancelFunc
 	wg                  sync.WaitGroup
+	repo                *git.Repository
+	repoLock            sync.RWMutex // 提交时写锁, 从对象库读文件时读锁
 	fileChan            chan FileObj
 	StorageFileMetaChan chan StorageFileMeta
+	statusHub           *StatusHub
+	lfs                 *lfsStore // 没开 LFS 时为空
 }
 
 func NewGitStorage() *GitStorage {
@@ -65,59 +107,315 @@ func (g *GitStorage) Init(cfg model.StorageConfig) error {
 	}
 	g.DB = db
 
-	g.DB = db
+	if g.cfg.LFSEnabled {
+		g.lfs, err = newLFSStore(g.ctx, g.cfg)
+		if err != nil {
+			g.ctxCancel()
+			db.Close()
+			return err
+		}
+	}
 	g.fileChan = make(chan FileObj, g.cfg.MaxPushFileAtOnce*2)
 	g.StorageFileMetaChan = make(chan StorageFileMeta, g.cfg.MaxPushFileAtOnce*2)
+	g.statusHub = NewStatusHub()
 
 	g.initGitService()
 	return nil
 }
 
+func (g *GitStorage) metaDB() *StorageDB {
+	return g.DB
+}
+
 func (g *GitStorage) Close() error {
 	g.ctxCancel()
 	g.wg.Wait()
-	close(g.fileChan)
-	close(g.StorageFileMetaChan)
+	close(g.fileChan) // StorageFileMetaChan 由 gitPushService 退出时关闭
 	return g.DB.Close()
 }
 
-func (g *GitStorage) Save(ctx context.Context, metaData model.MapMetaData, data []byte) (*model.MapMetaData, error) {
+// 上传内容先落到临时目录, fileChan 里只传路径, 不再把整个文件放内存里排队
+func (g *GitStorage) Save(ctx context.Context, metaData model.MapMetaData, reader io.Reader) (*model.MapMetaData, error) {
+	meta, file, err := g.prepareSave(ctx, metaData, reader)
+	if err != nil {
+		return meta, err
+	}
+	g.fileChan <- file
+	g.statusHub.Publish(meta.StatusEvent())
+	return meta, nil
+}
+
+// Save 里除了进提交队列以外的部分: 落盘, 校验, 写db
+func (g *GitStorage) prepareSave(ctx context.Context, metaData model.MapMetaData, reader io.Reader) (*model.MapMetaData, FileObj, error) {
+	spooled, err := SpoolToTemp(gitSpoolDir, reader)
+	if err != nil {
+		return nil, FileObj{}, err
+	}
+
+	existing, err := acceptSpooled(ctx, g.DB, &metaData, spooled)
+	if err != nil {
+		os.Remove(spooled.Path)
+		return existing, FileObj{}, err
+	}
+
 	metaData.SetStorageType(StorageTypeGitStorage)
 	metaData.SetStorageStatus(model.MapUploadStatusOnProgress, "")
-	g.DB.Add(ctx, metaData)
-	g.fileChan <- FileObj{Name: metaData.Name, Hash: metaData.Hash, Content: data}
-	return nil, nil
+	if err := g.DB.Add(ctx, metaData); err != nil {
+		os.Remove(spooled.Path)
+		return nil, FileObj{}, err
+	}
+	return &metaData, FileObj{
+		Op:             FileOpWrite,
+		Name:           metaData.Name,
+		Hash:           metaData.Hash,
+		TmpPath:        spooled.Path,
+		PreviewTmpPath: spoolPreview(gitSpoolDir, spooled.Path),
+		Meta:           &metaData,
+	}, nil
 }
 
-// TODO 未实现从git storage中读取文件的功能
-func (g *GitStorage) Get(ctx context.Context, hash string, writer io.Writer) (*model.MapMetaData, error) {
-	return nil, nil
+// 同一批次里 Save 的地图先攒着, Commit 时一起进提交队列, 保证落在同一个提交里
+type gitSaveBatch struct {
+	g     *GitStorage
+	mu    sync.Mutex
+	files []FileObj
 }
 
-func (g *GitStorage) GetMeta(ctx context.Context, hash string) (*model.MapMetaData, error) {
-	return g.DB.Get(ctx, hash)
+func (g *GitStorage) NewBatch() SaveBatch {
+	return &gitSaveBatch{g: g}
 }
 
-func (g *GitStorage) GetHistory(ctx context.Context, hash string, limit int) ([]model.MapMetaData, error) {
-	var result []model.MapMetaData
-	for {
-		metaData, err := g.DB.Get(ctx, hash)
+func (b *gitSaveBatch) Save(ctx context.Context, metaData model.MapMetaData, reader io.Reader) (*model.MapMetaData, error) {
+	meta, file, err := b.g.prepareSave(ctx, metaData, reader)
+	if err != nil {
+		return meta, err
+	}
+	b.mu.Lock()
+	b.files = append(b.files, file)
+	b.mu.Unlock()
+	b.g.statusHub.Publish(meta.StatusEvent())
+	return meta, nil
+}
+
+func (b *gitSaveBatch) Commit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.files) == 0 {
+		return
+	}
+	b.g.fileChan <- FileObj{Op: FileOpBatch, Batch: b.files}
+	b.files = nil
+}
+
+// 先读工作区, 工作区没有再去翻git对象库, 最后按迁移到按哈希存放之前的路径找.
+// 还在推送中或存储失败的地图返回 *MapNotReadyError
+func (g *GitStorage) Get(ctx context.Context, hash string, writer io.Writer) (*model.MapMetaData, error) {
+	metaData, err := g.DB.Get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if metaData.StorageStatus != model.MapUploadStatusSuccess {
+		return nil, &MapNotReadyError{Hash: hash, Status: metaData.StorageStatus, Reason: metaData.StorageStatusMsg}
+	}
+
+	relPath := repoMapPath(hash, metaData.Name)
+	found, err := g.copyPointerIfMatch(filepath.Join(g.cfg.GitWorkSpaceDir, relPath), hash, writer)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return metaData, nil
+	}
+	found, err = copyFileIfMatch(filepath.Join(g.cfg.GitWorkSpaceDir, relPath), hash, writer)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return metaData, nil
+	}
+
+	for _, historyPath := range []string{relPath, legacyRepoFilePath(metaData.Name, metaData.MapType)} {
+		found, err = g.copyBlobIfMatch(filepath.ToSlash(historyPath), hash, writer)
 		if err != nil {
 			return nil, err
 		}
-		result = append(result, *metaData)
-		hash = metaData.PrevHash
-		if hash == "" {
-			break
+		if found {
+			return metaData, nil
+		}
+	}
+	return nil, fmt.Errorf("%w : %s is not in git repo", ErrMapNotFound, hash)
+}
+
+// 工作区里是 oid 为 hash 的 LFS 指针时从 LFS 取内容
+func (g *GitStorage) copyPointerIfMatch(path string, hash string, writer io.Writer) (bool, error) {
+	pointer, ok, err := readLFSPointerFile(path)
+	if err != nil || !ok || pointer.Oid != hash {
+		return false, err
+	}
+	return true, g.lfs.copyObject(pointer, writer)
+}
+
+// 文件内容的sha256和hash一致才写到writer
+func copyFileIfMatch(path string, hash string, writer io.Writer) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	fileHash, err := utils.HashReader(file)
+	if err != nil || fileHash != hash {
+		return false, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	_, err = io.Copy(writer, file)
+	return err == nil, err
+}
+
+// 沿着提交历史找 relPath 下内容sha256为hash的blob, LFS 指针按 oid 比对
+func (g *GitStorage) copyBlobIfMatch(relPath string, hash string, writer io.Writer) (bool, error) {
+	g.repoLock.RLock()
+	defer g.repoLock.RUnlock()
+
+	file, pointer, err := g.findBlob(relPath, hash)
+	if err != nil || file == nil {
+		return false, err
+	}
+	if pointer != nil {
+		return true, g.lfs.copyObject(*pointer, writer)
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	_, err = io.Copy(writer, reader)
+	return err == nil, err
+}
+
+// 找不到时返回空. blob 是 LFS 指针时同时返回解析出来的指针. 调用方需要持有 repoLock
+func (g *GitStorage) findBlob(relPath string, hash string) (*object.File, *lfsPointer, error) {
+	head, err := g.repo.Head()
+	if err != nil {
+		return nil, nil, err
+	}
+	commitIter, err := g.repo.Log(&git.LogOptions{From: head.Hash(), FileName: &relPath})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer commitIter.Close()
+
+	var matched *object.File
+	var matchedPointer *lfsPointer
+	checked := make(map[plumbing.Hash]bool)
+	err = commitIter.ForEach(func(commit *object.Commit) error {
+		file, err := commit.File(relPath)
+		if err != nil {
+			return nil // 这个提交里文件被删掉了
+		}
+		if checked[file.Hash] {
+			return nil
+		}
+		checked[file.Hash] = true
+
+		if file.Size <= lfsMaxPointerSize {
+			content, err := file.Contents()
+			if err != nil {
+				return err
+			}
+			if pointer, ok := parseLFSPointer([]byte(content)); ok {
+				if pointer.Oid == hash {
+					matched, matchedPointer = file, &pointer
+					return storer.ErrStop
+				}
+				return nil
+			}
+		}
+
+		reader, err := file.Reader()
+		if err != nil {
+			return err
+		}
+		blobHash, err := utils.HashReader(reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		if blobHash == hash {
+			matched = file
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return matched, matchedPointer, nil
+}
+
+// 预览图按哈希命名, 不会被同名地图覆盖, 直接读工作区
+func (g *GitStorage) GetPreview(ctx context.Context, hash string, writer io.Writer) error {
+	metaData, err := g.DB.Get(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if metaData.StorageStatus != model.MapUploadStatusSuccess {
+		return &MapNotReadyError{Hash: hash, Status: metaData.StorageStatus, Reason: metaData.StorageStatusMsg}
+	}
+	path := filepath.Join(g.cfg.GitWorkSpaceDir, repoPreviewPath(hash))
+	pointer, ok, err := readLFSPointerFile(path)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return g.lfs.copyObject(pointer, writer)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w : %s", ErrPreviewNotFound, hash)
 		}
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+func (g *GitStorage) GetMeta(ctx context.Context, hash string) (*model.MapMetaData, error) {
+	return g.DB.Get(ctx, hash)
+}
+
+// db 里立即生效, 仓库里的元数据文件(以及改名)跟着下一批提交
+func (g *GitStorage) Update(ctx context.Context, hash string, update model.MapMetaDataUpdate) (*model.MapMetaData, error) {
+	oldMeta, err := g.DB.Get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.DB.UpdateFields(ctx, hash, update); err != nil {
+		return nil, err
+	}
+	metaData, err := g.DB.Get(ctx, hash)
+	if err != nil {
+		return nil, err
 	}
-	return result, nil
+	g.fileChan <- FileObj{Op: FileOpMeta, Name: metaData.Name, Hash: hash, OldName: oldMeta.Name, Meta: metaData}
+	return metaData, nil
+}
+
+func (g *GitStorage) GetHistory(ctx context.Context, hash string, limit int) (*model.MapHistory, error) {
+	return g.DB.History(ctx, hash, limit)
 }
 
 func (g *GitStorage) Exists(ctx context.Context, hash string) (bool, error) {
 	_, err := g.DB.Get(ctx, hash)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		if errors.Is(err, ErrMapNotFound) {
 			return false, nil
 		}
 		return false, err
@@ -133,20 +431,36 @@ func (g *GitStorage) Search(ctx context.Context, name string, limit int) ([]mode
 	return g.DB.Search(ctx, name, limit)
 }
 
+func (g *GitStorage) SearchMeta(ctx context.Context, search model.MapMetaDataSearch) ([]model.MapMetaData, error) {
+	return g.DB.SearchMeta(ctx, search)
+}
+
 func (g *GitStorage) List(ctx context.Context, page int, desc bool, orderField string, limit int) ([]model.MapMetaData, error) {
 	return g.DB.List(ctx, page, desc, orderField, limit)
 }
 
-// TODO 未实现git storage的文件删除功能
+// 先把状态改成删除中, 文件跟着下一批提交删掉, 推送成功后才删db记录
 func (g *GitStorage) Delete(ctx context.Context, hash string) error {
-	// TODO 删除git仓库内文件的功能还未实现
-
-	err := g.DB.Delete(ctx, hash)
+	metaData, err := g.DB.Get(ctx, hash)
 	if err != nil {
 		return err
 	}
+	err = g.DB.UpdateStatus(ctx, hash, model.MapDeleteStatusOnProgress, model.MapDeleteStatusMsgOnProgress)
+	if err != nil {
+		return err
+	}
+	g.fileChan <- FileObj{Op: FileOpDelete, Name: metaData.Name, Hash: hash, Meta: metaData}
+	metaData.SetStorageStatus(model.MapDeleteStatusOnProgress, "")
+	g.statusHub.Publish(metaData.StatusEvent())
 	return nil
+}
+
+func (g *GitStorage) SubscribeStatus(hash string) (<-chan model.MapStatusEvent, func()) {
+	return g.statusHub.Subscribe(hash)
+}
 
+func (g *GitStorage) LatestStatus(hash string) (model.MapStatusEvent, bool) {
+	return g.statusHub.Latest(hash)
 }
 
 func cleanUp(dirPath string) {
@@ -186,6 +500,24 @@ func (g *GitStorage) initGitService() {
 		return
 	}
 
+	if g.lfs != nil {
+		if err = writeLFSAttributes(g.cfg.GitWorkSpaceDir); err != nil {
+			log.Fatalf("Write .gitattributes Error : %v", err)
+			return
+		}
+	}
+
+	g.repo = repo
+	if err = g.migrateRepoLayout(workTree); err != nil {
+		log.Fatalf("Migrate repo layout Error : %v", err)
+		return
+	}
+
+	g.startPushService(repo, workTree)
+}
+
+// Close 取消 ctx 后推送协程做完手上这批再退出, 状态协程读完剩下的结果
+func (g *GitStorage) startPushService(repo *git.Repository, workTree *git.Worktree) {
 	g.wg.Add(2)
 	go func() {
 		defer g.wg.Done()
@@ -193,31 +525,29 @@ func (g *GitStorage) initGitService() {
 	}()
 	go func() {
 		defer g.wg.Done()
-		g.updateFileMetaToDB(g.ctx)
+		g.updateFileMetaToDB()
 	}()
-
 }
 
-func (g *GitStorage) updateFileMetaToDB(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			close(g.StorageFileMetaChan)
-			return
-		case fileMeta := <-g.StorageFileMetaChan:
-			var err error
+// 一直读到 gitPushService 关闭通道, 关闭时正在推送的那批结果也能写进db
+func (g *GitStorage) updateFileMetaToDB() {
+	ctx := context.Background()
+	for fileMeta := range g.StorageFileMetaChan {
+		// 中间阶段只广播, 结束了才写db
+		if fileMeta.Stage.IsFinal() {
 			log.Printf("Update metadata record for %s", fileMeta.Filename)
 
-			DBMeta := model.NewMetaData(fileMeta.Hash, fileMeta.Filename)
-			DBMeta.StorageStatus = fileMeta.Status
-			DBMeta.StorageStatusMsg = fileMeta.Reason
-
-			err = g.DB.Update(ctx, DBMeta)
+			var err error
+			if fileMeta.Op == FileOpDelete && !fileMeta.failed() {
+				err = g.DB.Delete(ctx, fileMeta.Hash)
+			} else {
+				err = g.DB.UpdateStatus(ctx, fileMeta.Hash, fileMeta.Status, fileMeta.Reason)
+			}
 			if err != nil {
-				log.Printf("failed to record failed metadata for %s: %v", DBMeta.Name, err)
+				log.Printf("failed to record failed metadata for %s: %v", fileMeta.Filename, err)
 			}
-
 		}
+		g.statusHub.Publish(fileMeta.statusEvent())
 	}
 }
 
@@ -225,12 +555,54 @@ func setFileMetaMapAllFailed(storageFileMetaMap map[string]StorageFileMeta, reas
 	for hash := range storageFileMetaMap {
 		fileMeta := storageFileMetaMap[hash]
 		fileMeta.Status = model.MapUploadStatusFailed
+		if fileMeta.Op == FileOpDelete {
+			fileMeta.Status = model.MapDeleteStatusFailed
+		}
 		fileMeta.Reason = reason
 		storageFileMetaMap[hash] = fileMeta
 	}
 }
 
+// 发送中间阶段, 已经失败的文件不再发
+func (g *GitStorage) reportStage(storageFileMetaMap map[string]StorageFileMeta, stage model.MapStorageStage) {
+	for _, fileMeta := range storageFileMetaMap {
+		if fileMeta.failed() {
+			continue
+		}
+		fileMeta.Stage = stage
+		fileMeta.Status, fileMeta.Reason = model.MapUploadStatusOnProgress, model.MapUploadStatusMsgOnProgress
+		if fileMeta.Op == FileOpDelete {
+			fileMeta.Status, fileMeta.Reason = model.MapDeleteStatusOnProgress, model.MapDeleteStatusMsgOnProgress
+		}
+		g.StorageFileMetaChan <- fileMeta
+	}
+}
+
+// 发送最终结果, 失败的是 failed, 其余是 pushed
+func (g *GitStorage) reportFileMeta(storageFileMetaMap map[string]StorageFileMeta) {
+	for _, fileMeta := range storageFileMetaMap {
+		fileMeta.Stage = model.MapStagePushed
+		if fileMeta.failed() {
+			fileMeta.Stage = model.MapStageFailed
+		}
+		g.StorageFileMetaChan <- fileMeta
+	}
+}
+
+func commitTitle(writes int, metaUpdates int, deletes int) string {
+	title := fmt.Sprintf("%d maps", writes)
+	if metaUpdates > 0 {
+		title += fmt.Sprintf(" , %d metadata updates", metaUpdates)
+	}
+	if deletes > 0 {
+		title += fmt.Sprintf(" , %d deleted", deletes)
+	}
+	return title + " , " + utils.ISO8601LocalNow()
+}
+
+// 只有这里往 StorageFileMetaChan 发送, 退出时由这里关闭
 func (g *GitStorage) gitPushService(ctx context.Context, repo *git.Repository, workTree *git.Worktree, dirPath string, fileChan chan FileObj) {
+	defer close(g.StorageFileMetaChan)
 	eg, _ := errgroup.WithContext(ctx)
 	eg.SetLimit(int(g.cfg.WriteFileWorkers))
 
@@ -240,50 +612,83 @@ func (g *GitStorage) gitPushService(ctx context.Context, repo *git.Repository, w
 
 		batch := g.collectFile(fileChan)
 		if len(batch) == 0 {
+			// 队列里还有的做完再退出
+			if ctx.Err() != nil && len(fileChan) == 0 {
+				return
+			}
 			continue
 		}
-		batchFileNumber := len(batch)
+		var writes, metaUpdates, deletes []FileObj
+		for _, file := range batch {
+			switch file.Op {
+			case FileOpBatch:
+				writes = append(writes, file.Batch...)
+			case FileOpWrite:
+				writes = append(writes, file)
+			case FileOpMeta:
+				metaUpdates = append(metaUpdates, file)
+			case FileOpDelete:
+				deletes = append(deletes, file)
+			}
+		}
 
-		storageFiles := writeFileBatch(batch, dirPath, eg)
+		storageFiles := writeFileBatch(writes, dirPath, g.lfs, eg)
 		for _, storageFile := range storageFiles {
 			storageFileMetaMap[storageFile.Hash] = storageFile
 		}
 
+		g.repoLock.Lock()
+		// 元数据修改要在新文件写完之后执行, 同一批里先上传再改名的情况才能找到文件
+		indexChanged := applyMetaUpdates(workTree, dirPath, metaUpdates)
+		// 删除放在最后, 同一批里先上传再删除的地图也能删掉
+		for _, deleted := range applyDeletes(workTree, dirPath, deletes) {
+			storageFileMetaMap[deleted.Hash] = deleted
+		}
+		// 要读全部元数据文件, 只在增删地图或者改了名字作者时重新生成. 新仓库的第一次提交会带上
+		if len(writes) > 0 || len(deletes) > 0 || indexChanged || !utils.FileExists(filepath.Join(dirPath, repoIndexFile)) {
+			if err := writeRepoIndex(dirPath); err != nil {
+				log.Printf("failed to write %s : %v", repoIndexFile, err)
+			}
+		}
+		g.reportStage(storageFileMetaMap, model.MapStageWritten)
+
 		log.Printf("Adding all file to git index")
 		err = workTree.AddGlob("*")
 		if err != nil {
+			g.repoLock.Unlock()
 			errStr := fmt.Sprintf("Git Add Error : %v", err)
 			log.Println(errStr)
 			setFileMetaMapAllFailed(storageFileMetaMap, errStr)
+			g.reportFileMeta(storageFileMetaMap)
 			continue
 		}
 
 		log.Printf("Creating commit")
-		commitTitle := fmt.Sprintf("%d maps , %s", batchFileNumber, utils.ISO8601LocalNow())
-		_, err = workTree.Commit(commitTitle, &git.CommitOptions{
+		_, err = workTree.Commit(commitTitle(len(writes), len(metaUpdates), len(deletes)), &git.CommitOptions{
 			Author: &object.Signature{Name: g.cfg.CommitAuthor, Email: g.cfg.CommitEmail, When: time.Now()},
 		})
+		g.repoLock.Unlock()
+		if errors.Is(err, git.ErrEmptyCommit) {
+			// 内容和仓库里已有的完全一样, 仍然推送一次, 之前推送失败留下的提交可以跟着上去
+			log.Println("Git commit is empty, skip")
+			err = nil
+		}
 		if err != nil {
-			if errors.Is(err, git.ErrEmptyCommit) {
-				log.Println("Git commit is empty, skip")
-				continue
-			}
 			errStr := fmt.Sprintf("Git create commit Error : %v", err)
 			log.Println(errStr)
 			setFileMetaMapAllFailed(storageFileMetaMap, errStr)
+			g.reportFileMeta(storageFileMetaMap)
 			continue
 		}
+		g.reportStage(storageFileMetaMap, model.MapStageCommitted)
 
 		err = g.gitPush(repo, "")
 		if err != nil {
 			errStr := fmt.Sprintf("Git Push Error : %v", err)
 			log.Println(errStr)
 			setFileMetaMapAllFailed(storageFileMetaMap, errStr)
-			continue
-		}
-		for _, fileMeta := range storageFileMetaMap {
-			g.StorageFileMetaChan <- fileMeta
 		}
+		g.reportFileMeta(storageFileMetaMap)
 	}
 }
 
@@ -317,17 +722,33 @@ func (g *GitStorage) collectFile(fileChan <-chan FileObj) []FileObj {
 	}
 }
 
-// 用 errgroup 池化并发写文件
-func writeFileBatch(batch []FileObj, dirPath string, eg *errgroup.Group) []StorageFileMeta {
+// 用 errgroup 池化并发写文件, lfs 不为空时大文件写成 LFS 指针
+func writeFileBatch(batch []FileObj, dirPath string, lfs *lfsStore, eg *errgroup.Group) []StorageFileMeta {
 	log.Printf("Writing %d files to %q", len(batch), dirPath)
 	var mu sync.Mutex
 	var result []StorageFileMeta
 
 	for _, file := range batch {
 		eg.Go(func() error {
-			filePath := filepath.Join(dirPath,
-				utils.AddSuffixIfMissing(file.Name, "map"))
-			if err := os.WriteFile(filePath, file.Content, 0644); err != nil {
+			filePath := filepath.Join(dirPath, repoMapPath(file.Hash, file.Name))
+			err := os.MkdirAll(filepath.Dir(filePath), 0755)
+			if err == nil {
+				err = lfs.place(file.TmpPath, filePath)
+			}
+			if err == nil {
+				err = writeRepoMeta(dirPath, file.Meta)
+			}
+			if err == nil && file.PreviewTmpPath != "" {
+				// 预览图写失败不影响地图本身
+				if previewErr := writeRepoPreview(dirPath, file.Hash, file.PreviewTmpPath, lfs); previewErr != nil {
+					log.Printf("failed to write preview of %s: %v", file.Hash, previewErr)
+				}
+			}
+			if err != nil {
+				os.Remove(file.TmpPath)
+				if file.PreviewTmpPath != "" {
+					os.Remove(file.PreviewTmpPath)
+				}
 				mu.Lock()
 				result = append(result, StorageFileMeta{
 					Filename: file.Name,
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"map-storage-cnb/src/model"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// 把按名字放在仓库根目录的地图复制到 maps/ab/<hash>.<ext>, 启动时执行, 全部复制完作为一个提交推送.
+// 以db为准: 存储成功的地图在新路径上还没有文件时, 先找旧路径下的工作区文件,
+// 内容对不上(被同名地图覆盖了)再从旧路径的提交历史里找, 所以之前被覆盖的地图迁移之后也能直接读到.
+// 改名时没搬成的地图还在旧名字下, 最后按内容在根目录里找.
+// 旧路径上的文件原样留在仓库里, 已经发出去的文件链接还能打开
+func (g *GitStorage) migrateRepoLayout(workTree *git.Worktree) error {
+	dirPath := g.cfg.GitWorkSpaceDir
+	records, err := g.DB.ListByStatus(context.Background(), model.MapUploadStatusSuccess)
+	if err != nil {
+		return err
+	}
+
+	copied, restored := 0, 0
+	var rootFiles map[string]string
+	for _, meta := range records {
+		newPath := repoMapPath(meta.Hash, meta.Name)
+		if _, err := os.Stat(filepath.Join(dirPath, newPath)); err == nil {
+			continue
+		}
+		legacyPath := legacyRepoFilePath(meta.Name, meta.MapType)
+		if !filepath.IsLocal(legacyPath) {
+			log.Printf("skip migrating %s : legacy path %q is outside the repo", meta.Hash, legacyPath)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(dirPath, filepath.Dir(newPath)), 0755); err != nil {
+			return err
+		}
+
+		matched, err := storedFileMatches(filepath.Join(dirPath, legacyPath), meta.Hash)
+		if err != nil {
+			return err
+		}
+		if matched {
+			if err := copyRepoFile(filepath.Join(dirPath, legacyPath), filepath.Join(dirPath, newPath)); err != nil {
+				return err
+			}
+			copied++
+		} else {
+			file, _, err := g.findBlob(filepath.ToSlash(legacyPath), meta.Hash)
+			if err != nil {
+				return fmt.Errorf("search history of %q : %w", legacyPath, err)
+			}
+			if file != nil {
+				if err := writeBlob(file, filepath.Join(dirPath, newPath)); err != nil {
+					return err
+				}
+				restored++
+			} else {
+				if rootFiles == nil {
+					if rootFiles, err = hashRootFiles(dirPath); err != nil {
+						return err
+					}
+				}
+				path, ok := rootFiles[meta.Hash]
+				if !ok {
+					log.Printf("map %s (%q) is not in git repo, skip migrating", meta.Hash, meta.Name)
+					continue
+				}
+				if err := copyRepoFile(filepath.Join(dirPath, path), filepath.Join(dirPath, newPath)); err != nil {
+					return err
+				}
+				copied++
+			}
+		}
+		// INDEX.md 按元数据文件生成
+		if err := writeRepoMeta(dirPath, &meta); err != nil {
+			return err
+		}
+	}
+
+	// 新仓库没有要搬的, INDEX.md 跟着第一次正常提交生成
+	if copied == 0 && restored == 0 {
+		return nil
+	}
+	log.Printf("migrating repo layout : %d maps copied, %d restored from history", copied, restored)
+
+	if err := writeRepoIndex(dirPath); err != nil {
+		return err
+	}
+	if err := workTree.AddGlob("*"); err != nil {
+		return err
+	}
+	_, err = workTree.Commit(fmt.Sprintf("migrate %d maps to content addressed layout", copied+restored), &git.CommitOptions{
+		Author: &object.Signature{Name: g.cfg.CommitAuthor, Email: g.cfg.CommitEmail, When: time.Now()},
+	})
+	if err != nil && !errors.Is(err, git.ErrEmptyCommit) {
+		return err
+	}
+	return g.gitPush(g.repo, "")
+}
+
+// 文件内容是这张地图, 或者是指向这张地图的 LFS 指针
+func storedFileMatches(path string, hash string) (bool, error) {
+	pointer, ok, err := readLFSPointerFile(path)
+	if err != nil || ok {
+		return ok && pointer.Oid == hash, err
+	}
+	fileHash, err := hashFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return fileHash == hash, nil
+}
+
+// 根目录下文件的内容哈希到文件名, LFS 指针按指向的对象算
+func hashRootFiles(dirPath string) (map[string]string, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") || entry.Name() == repoIndexFile {
+			continue
+		}
+		path := filepath.Join(dirPath, entry.Name())
+		pointer, ok, err := readLFSPointerFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			files[pointer.Oid] = entry.Name()
+			continue
+		}
+		fileHash, err := hashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[fileHash] = entry.Name()
+	}
+	return files, nil
+}
+
+// blob 原样写出来, LFS 指针也是原样的指针
+func writeBlob(file *object.File, path string) error {
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return writeFileFrom(path, reader)
+}
+
+// 工作区里的文件原样复制, LFS 指针也是复制指针
+func copyRepoFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFileFrom(dst, in)
+}
+
+func writeFileFrom(path string, reader io.Reader) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"map-storage-cnb/src/model"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestMigrateRepoLayoutFreshRepo(t *testing.T) {
+	g, workTree := newTestGitStorage(t, newFakeLFS(t))
+	if err := g.migrateRepoLayout(workTree); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.repo.Head(); err == nil {
+		t.Error("fresh repo should have no commit")
+	}
+}
+
+// 迁移提交推到本地的裸仓库
+func addTestRemote(t *testing.T, repo *git.Repository) *git.Repository {
+	remoteDir := t.TempDir()
+	remote, err := git.PlainInit(remoteDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remoteDir}}); err != nil {
+		t.Fatal(err)
+	}
+	return remote
+}
+
+func writeRepoFile(t *testing.T, dirPath string, name string, data []byte) {
+	if err := os.WriteFile(filepath.Join(dirPath, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addSuccessMeta(t *testing.T, g *GitStorage, data []byte, name string, mapType model.MapType) model.MapMetaData {
+	meta := model.NewMetaData(sha256Hex(data), name)
+	meta.MapType = mapType
+	meta.SetStorageStatus(model.MapUploadStatusSuccess, "")
+	if err := g.DB.Add(context.Background(), meta); err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+// 旧布局: 同名地图覆盖了前一张, 改名搬过一次的地图, 改名没搬成还留在旧名字下的地图
+func TestMigrateRepoLayout(t *testing.T) {
+	g, workTree := newTestGitStorage(t, newFakeLFS(t))
+	remote := addTestRemote(t, g.repo)
+	dirPath := g.cfg.GitWorkSpaceDir
+
+	first, second := randomBytes(t, 256), randomBytes(t, 256)
+	renamed, unmoved := randomBytes(t, 256), randomBytes(t, 256)
+	writeRepoFile(t, dirPath, "same.map", first)
+	writeRepoFile(t, dirPath, "before.yrm", renamed)
+	writeRepoFile(t, dirPath, "stale.map", unmoved)
+	commitAll(t, workTree, "upload")
+	writeRepoFile(t, dirPath, "same.map", second)
+	if err := os.Rename(filepath.Join(dirPath, "before.yrm"), filepath.Join(dirPath, "after.yrm")); err != nil {
+		t.Fatal(err)
+	}
+	commitAll(t, workTree, "overwrite and rename")
+
+	metas := []model.MapMetaData{
+		addSuccessMeta(t, g, first, "same", ""),
+		addSuccessMeta(t, g, second, "same.map", model.MapTypeYR),
+		addSuccessMeta(t, g, renamed, "after.yrm", model.MapTypeYR),
+		addSuccessMeta(t, g, unmoved, "fresh.map", model.MapTypeRA2),
+		addSuccessMeta(t, g, randomBytes(t, 16), "lost.map", model.MapTypeRA2),
+	}
+	contents := [][]byte{first, second, renamed, unmoved}
+
+	if err := g.migrateRepoLayout(workTree); err != nil {
+		t.Fatal(err)
+	}
+	for i, data := range contents {
+		path := repoMapPath(metas[i].Hash, metas[i].Name)
+		got, err := os.ReadFile(filepath.Join(dirPath, path))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: content mismatch, err = %v", path, err)
+		}
+		if _, err := os.Stat(filepath.Join(dirPath, repoMetaPath(metas[i].Hash))); err != nil {
+			t.Errorf("%s: %v", metas[i].Name, err)
+		}
+		var buf bytes.Buffer
+		if _, err := g.Get(context.Background(), metas[i].Hash, &buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("Get %s: err = %v", metas[i].Name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dirPath, repoMetaPath(metas[4].Hash))); !os.IsNotExist(err) {
+		t.Errorf("map missing from repo should not get metadata, err = %v", err)
+	}
+
+	index, err := os.ReadFile(filepath.Join(dirPath, repoIndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(index), "4 maps.") {
+		t.Errorf("index:\n%s", index)
+	}
+	for _, meta := range metas[:4] {
+		if !strings.Contains(string(index), "("+filepath.ToSlash(repoMapPath(meta.Hash, meta.Name))+")") {
+			t.Errorf("index does not link %s:\n%s", meta.Name, index)
+		}
+	}
+
+	// 旧路径的文件还在, 也还在提交里
+	head, err := g.repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := g.repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Message != "migrate 4 maps to content addressed layout" {
+		t.Errorf("commit message = %q", commit.Message)
+	}
+	for name, data := range map[string][]byte{"same.map": second, "after.yrm": renamed, "stale.map": unmoved} {
+		file, err := commit.File(name)
+		if err != nil {
+			t.Errorf("legacy %s: %v", name, err)
+			continue
+		}
+		content, err := file.Contents()
+		if err != nil || content != string(data) {
+			t.Errorf("legacy %s changed, err = %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dirPath, name)); err != nil {
+			t.Errorf("legacy %s: %v", name, err)
+		}
+	}
+	status, err := workTree.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.IsClean() {
+		t.Errorf("worktree not clean after migration:\n%s", status)
+	}
+
+	pushed, err := remote.Reference(plumbing.NewBranchReferenceName("master"), true)
+	if err != nil || pushed.Hash() != head.Hash() {
+		t.Errorf("migration not pushed, err = %v", err)
+	}
+
+	// 再启动一次什么都不用做
+	if err := g.migrateRepoLayout(workTree); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := g.repo.Head(); err != nil || again.Hash() != head.Hash() {
+		t.Errorf("second migration made a commit, err = %v", err)
+	}
+}
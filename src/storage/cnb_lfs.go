@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"map-storage-cnb/src/model"
+)
+
+const (
+	lfsMediaType      = "application/vnd.git-lfs+json"
+	lfsPointerVersion = "https://git-lfs.github.com/spec/v1"
+	// 指针文件不会超过这个大小, 大于这个的一定不是指针
+	lfsMaxPointerSize = 1024
+)
+
+// 让装了 git-lfs 的客户端克隆时自动换成真正的文件, 没超过阈值的普通文件 git-lfs 会原样输出
+var lfsAttributes = []string{
+	"*.map filter=lfs diff=lfs merge=lfs -text",
+	"*.mpr filter=lfs diff=lfs merge=lfs -text",
+	"*.yrm filter=lfs diff=lfs merge=lfs -text",
+	"*.yro filter=lfs diff=lfs merge=lfs -text",
+	repoPreviewDir + "/*.png filter=lfs diff=lfs merge=lfs -text",
+}
+
+// LFS 指针, oid 是内容的 sha256
+type lfsPointer struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+func (p lfsPointer) String() string {
+	return fmt.Sprintf("version %s\noid sha256:%s\nsize %d\n", lfsPointerVersion, p.Oid, p.Size)
+}
+
+// 不是指针返回 false
+func parseLFSPointer(data []byte) (lfsPointer, bool) {
+	if len(data) > lfsMaxPointerSize || !bytes.HasPrefix(data, []byte("version "+lfsPointerVersion)) {
+		return lfsPointer{}, false
+	}
+	var pointer lfsPointer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		switch key {
+		case "oid":
+			pointer.Oid = strings.TrimPrefix(value, "sha256:")
+		case "size":
+			pointer.Size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	if _, err := hex.DecodeString(pointer.Oid); err != nil || len(pointer.Oid) != 64 {
+		return lfsPointer{}, false
+	}
+	return pointer, true
+}
+
+// 读文件, 是指针才返回
+func readLFSPointerFile(path string) (lfsPointer, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lfsPointer{}, false, nil
+		}
+		return lfsPointer{}, false, err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, lfsMaxPointerSize+1))
+	if err != nil {
+		return lfsPointer{}, false, err
+	}
+	pointer, ok := parseLFSPointer(data)
+	return pointer, ok, nil
+}
+
+// 超过阈值的文件放到 LFS, 本地对象缓存和 git-lfs 一样放在 .git/lfs/objects 下
+type lfsStore struct {
+	ctx       context.Context
+	endpoint  string
+	username  string
+	password  string
+	threshold int64
+	cacheDir  string
+	http      *http.Client
+}
+
+// LFSURL 为空时按 git-lfs 的规则从远程仓库地址推算, 只支持 http(s) 的远程仓库
+func newLFSStore(ctx context.Context, cfg model.GitStorageConfig) (*lfsStore, error) {
+	endpoint := strings.TrimSuffix(cfg.LFSURL, "/")
+	if endpoint == "" {
+		remote := strings.TrimSuffix(cfg.RemoteGitRepoUrl, "/")
+		if !strings.HasPrefix(remote, "http://") && !strings.HasPrefix(remote, "https://") {
+			return nil, fmt.Errorf("LFSURL is required for non-http remote %q", cfg.RemoteGitRepoUrl)
+		}
+		if !strings.HasSuffix(remote, ".git") {
+			remote += ".git"
+		}
+		endpoint = remote + "/info/lfs"
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid LFSURL %q : %w", endpoint, err)
+	}
+	return &lfsStore{
+		ctx:       ctx,
+		endpoint:  endpoint,
+		username:  cfg.LFSUsername,
+		password:  cfg.LFSPassword,
+		threshold: cfg.LFSThreshold,
+		cacheDir:  filepath.Join(cfg.GitWorkSpaceDir, ".git", "lfs", "objects"),
+		http:      &http.Client{},
+	}, nil
+}
+
+func (s *lfsStore) cachePath(oid string) string {
+	return filepath.Join(s.cacheDir, oid[0:2], oid[2:4], oid)
+}
+
+// 把 src 放到仓库里的 dst. s 为空或者没超过阈值直接移动,
+// 否则先上传到 LFS 服务, 内容进本地缓存, dst 写成指针
+func (s *lfsStore) place(src string, dst string) error {
+	if s == nil {
+		return moveFile(src, dst)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.Size() <= s.threshold {
+		return moveFile(src, dst)
+	}
+
+	oid, err := hashFile(src)
+	if err != nil {
+		return err
+	}
+	pointer := lfsPointer{Oid: oid, Size: info.Size()}
+	if err := s.upload(pointer, src); err != nil {
+		return fmt.Errorf("lfs upload %s failed : %w", oid, err)
+	}
+	cache := s.cachePath(oid)
+	if err := os.MkdirAll(filepath.Dir(cache), 0755); err != nil {
+		return err
+	}
+	if err := moveFile(src, cache); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, []byte(pointer.String()), 0644)
+}
+
+// 先读本地缓存, 没有再从 LFS 服务下载到缓存
+func (s *lfsStore) copyObject(pointer lfsPointer, writer io.Writer) error {
+	if s == nil {
+		return fmt.Errorf("%s is a lfs pointer but LFS is not enabled", pointer.Oid)
+	}
+	cache := s.cachePath(pointer.Oid)
+	if !fileHasHash(cache, pointer.Oid) {
+		if err := s.download(pointer, cache); err != nil {
+			return fmt.Errorf("lfs download %s failed : %w", pointer.Oid, err)
+		}
+	}
+	file, err := os.Open(cache)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+func fileHasHash(path string, hash string) bool {
+	fileHash, err := hashFile(path)
+	return err == nil && fileHash == hash
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+type lfsBatchObject struct {
+	Oid     string               `json:"oid"`
+	Size    int64                `json:"size"`
+	Actions map[string]lfsAction `json:"actions,omitempty"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// batch 接口, 一次只问一个对象, 返回服务端给的操作, 服务端已经有的对象上传时没有操作
+func (s *lfsStore) batch(operation string, pointer lfsPointer) (map[string]lfsAction, error) {
+	body, err := json.Marshal(map[string]any{
+		"operation": operation,
+		"transfers": []string{"basic"},
+		"objects":   []lfsPointer{pointer},
+		"hash_algo": "sha256",
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	s.setAuth(req)
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, lfsResponseError(resp)
+	}
+	var result struct {
+		Objects []lfsBatchObject `json:"objects"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode batch response : %w", err)
+	}
+	for _, object := range result.Objects {
+		if object.Oid != pointer.Oid {
+			continue
+		}
+		if object.Error != nil {
+			return nil, fmt.Errorf("batch %s error %d : %s", operation, object.Error.Code, object.Error.Message)
+		}
+		return object.Actions, nil
+	}
+	return nil, fmt.Errorf("batch %s response missing object %s", operation, pointer.Oid)
+}
+
+func (s *lfsStore) upload(pointer lfsPointer, path string) error {
+	actions, err := s.batch("upload", pointer)
+	if err != nil {
+		return err
+	}
+	if upload, ok := actions["upload"]; ok {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		req, err := s.actionRequest(http.MethodPut, upload, file)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = pointer.Size
+		if req.Header.Get("Content-Type") == "" {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		if err := s.doAction(req); err != nil {
+			return err
+		}
+	}
+	if verify, ok := actions["verify"]; ok {
+		body, err := json.Marshal(pointer)
+		if err != nil {
+			return err
+		}
+		req, err := s.actionRequest(http.MethodPost, verify, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", lfsMediaType)
+		req.Header.Set("Accept", lfsMediaType)
+		return s.doAction(req)
+	}
+	return nil
+}
+
+// 下载到临时文件, 校验哈希之后再改名成缓存文件
+func (s *lfsStore) download(pointer lfsPointer, cache string) error {
+	actions, err := s.batch("download", pointer)
+	if err != nil {
+		return err
+	}
+	download, ok := actions["download"]
+	if !ok {
+		return fmt.Errorf("no download action for %s", pointer.Oid)
+	}
+	req, err := s.actionRequest(http.MethodGet, download, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return lfsResponseError(resp)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cache), 0755); err != nil {
+		return err
+	}
+	spooled, err := SpoolToTemp(filepath.Dir(cache), resp.Body)
+	if err != nil {
+		return err
+	}
+	if spooled.Hash != pointer.Oid {
+		os.Remove(spooled.Path)
+		return fmt.Errorf("%w : expect %s but got %s", ErrHashMismatch, pointer.Oid, spooled.Hash)
+	}
+	return os.Rename(spooled.Path, cache)
+}
+
+// 操作自带的请求头优先(一般是临时授权), 没有授权头且和 LFS 服务同一个主机时用配置的账号
+func (s *lfsStore) actionRequest(method string, action lfsAction, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(s.ctx, method, action.Href, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range action.Header {
+		req.Header.Set(name, value)
+	}
+	if req.Header.Get("Authorization") == "" {
+		if endpoint, err := url.Parse(s.endpoint); err == nil && endpoint.Host == req.URL.Host {
+			s.setAuth(req)
+		}
+	}
+	return req, nil
+}
+
+func (s *lfsStore) doAction(req *http.Request) error {
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return lfsResponseError(resp)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (s *lfsStore) setAuth(req *http.Request) {
+	if s.username != "" || s.password != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+}
+
+func lfsResponseError(resp *http.Response) error {
+	var body struct {
+		Message string `json:"message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) != nil || body.Message == "" {
+		body.Message = strings.TrimSpace(string(data))
+	}
+	return fmt.Errorf("lfs server %d : %s", resp.StatusCode, body.Message)
+}
+
+// 确保 .gitattributes 里有 LFS 的规则, 已有的其它规则保留
+func writeLFSAttributes(dirPath string) error {
+	path := filepath.Join(dirPath, ".gitattributes")
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		existing[strings.TrimSpace(line)] = true
+	}
+	var missing []string
+	for _, line := range lfsAttributes {
+		if !existing[line] {
+			missing = append(missing, line)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	data = append(data, strings.Join(missing, "\n")+"\n"...)
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"map-storage-cnb/src/model"
+)
+
+// 内存里的 LFS 服务, 只支持 basic 传输
+type fakeLFS struct {
+	mu       sync.Mutex
+	url      string
+	objects  map[string][]byte
+	requests []string
+	// 下载时返回的内容, 用来模拟损坏的对象
+	corrupt map[string][]byte
+}
+
+func newFakeLFS(t *testing.T) *fakeLFS {
+	fake := &fakeLFS{objects: make(map[string][]byte), corrupt: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.url = server.URL
+	return fake
+}
+
+func (f *fakeLFS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	if username, password, ok := r.BasicAuth(); !ok || username != "bot" || password != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "bad credentials"})
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/objects/batch":
+		var request struct {
+			Operation string       `json:"operation"`
+			Objects   []lfsPointer `json:"objects"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var objects []lfsBatchObject
+		for _, pointer := range request.Objects {
+			object := lfsBatchObject{Oid: pointer.Oid, Size: pointer.Size, Actions: map[string]lfsAction{}}
+			_, exists := f.objects[pointer.Oid]
+			switch {
+			case request.Operation == "upload" && !exists:
+				object.Actions["upload"] = lfsAction{Href: f.url + "/objects/" + pointer.Oid}
+				object.Actions["verify"] = lfsAction{Href: f.url + "/verify"}
+			case request.Operation == "download" && exists:
+				object.Actions["download"] = lfsAction{Href: f.url + "/objects/" + pointer.Oid}
+			}
+			objects = append(objects, object)
+		}
+		w.Header().Set("Content-Type", lfsMediaType)
+		json.NewEncoder(w).Encode(map[string]any{"objects": objects})
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/objects/"):
+		var buf bytes.Buffer
+		buf.ReadFrom(r.Body)
+		f.objects[strings.TrimPrefix(r.URL.Path, "/objects/")] = buf.Bytes()
+	case r.Method == http.MethodPost && r.URL.Path == "/verify":
+		var pointer lfsPointer
+		json.NewDecoder(r.Body).Decode(&pointer)
+		if data, ok := f.objects[pointer.Oid]; !ok || int64(len(data)) != pointer.Size {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "object not found"})
+		}
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/objects/"):
+		oid := strings.TrimPrefix(r.URL.Path, "/objects/")
+		if data, ok := f.corrupt[oid]; ok {
+			w.Write(data)
+			return
+		}
+		w.Write(f.objects[oid])
+	default:
+		http.Error(w, "unsupported", http.StatusNotFound)
+	}
+}
+
+func (f *fakeLFS) count(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, request := range f.requests {
+		if strings.HasPrefix(request, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestLFSStore(t *testing.T, fake *fakeLFS, workspace string) *lfsStore {
+	store, err := newLFSStore(context.Background(), model.GitStorageConfig{
+		GitWorkSpaceDir: workspace,
+		LFSURL:          fake.url,
+		LFSUsername:     "bot",
+		LFSPassword:     "token",
+		LFSThreshold:    100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseLFSPointer(t *testing.T) {
+	oid := strings.Repeat("ab", 32)
+	for _, tc := range []struct {
+		name string
+		data string
+		want lfsPointer
+		ok   bool
+	}{
+		{"valid", lfsPointer{Oid: oid, Size: 12345}.String(), lfsPointer{Oid: oid, Size: 12345}, true},
+		{"extension lines", "version " + lfsPointerVersion + "\next-0-foo sha256:" + oid + "\noid sha256:" + oid + "\nsize 7\n", lfsPointer{Oid: oid, Size: 7}, true},
+		{"no trailing newline", "version " + lfsPointerVersion + "\noid sha256:" + oid + "\nsize 7", lfsPointer{Oid: oid, Size: 7}, true},
+		{"not a pointer", "[Basic]\nName=test\n", lfsPointer{}, false},
+		{"other version", "version https://hawser.github.com/spec/v1\noid sha256:" + oid + "\nsize 7\n", lfsPointer{}, false},
+		{"short oid", "version " + lfsPointerVersion + "\noid sha256:abcd\nsize 7\n", lfsPointer{}, false},
+		{"non hex oid", "version " + lfsPointerVersion + "\noid sha256:" + strings.Repeat("zz", 32) + "\nsize 7\n", lfsPointer{}, false},
+		{"missing oid", "version " + lfsPointerVersion + "\nsize 7\n", lfsPointer{}, false},
+		{"too large", lfsPointer{Oid: oid, Size: 7}.String() + strings.Repeat("x", lfsMaxPointerSize), lfsPointer{}, false},
+	} {
+		got, ok := parseLFSPointer([]byte(tc.data))
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("%s: got %+v %v, want %+v %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestLFSPlaceUploadsLargeFile(t *testing.T) {
+	fake := newFakeLFS(t)
+	workspace := t.TempDir()
+	store := newTestLFSStore(t, fake, workspace)
+
+	data := randomBytes(t, 4096)
+	oid := sha256Hex(data)
+	src := filepath.Join(t.TempDir(), "upload.tmp")
+	writeTestFile(t, src, data)
+	dst := filepath.Join(workspace, "big.map")
+	if err := store.place(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fake.objects[oid], data) {
+		t.Error("object not uploaded")
+	}
+	if n := fake.count("POST /verify"); n != 1 {
+		t.Errorf("want one verify, got %d", n)
+	}
+	pointer, ok, err := readLFSPointerFile(dst)
+	if err != nil || !ok || pointer != (lfsPointer{Oid: oid, Size: int64(len(data))}) {
+		t.Errorf("dst is not the pointer: %+v %v %v", pointer, ok, err)
+	}
+	if !fileHasHash(store.cachePath(oid), oid) {
+		t.Error("content not in local cache")
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Error("src should be moved")
+	}
+}
+
+func TestLFSPlaceSmallFile(t *testing.T) {
+	fake := newFakeLFS(t)
+	workspace := t.TempDir()
+	store := newTestLFSStore(t, fake, workspace)
+
+	data := []byte("[Basic]\nName=small\n")
+	src := filepath.Join(t.TempDir(), "upload.tmp")
+	writeTestFile(t, src, data)
+	dst := filepath.Join(workspace, "small.map")
+	if err := store.place(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dst); !bytes.Equal(got, data) {
+		t.Error("small file should be moved as is")
+	}
+	if n := fake.count(""); n != 0 {
+		t.Errorf("small file should not touch the lfs server, got %d requests", n)
+	}
+}
+
+func TestLFSUploadExistingObject(t *testing.T) {
+	fake := newFakeLFS(t)
+	store := newTestLFSStore(t, fake, t.TempDir())
+
+	data := randomBytes(t, 4096)
+	oid := sha256Hex(data)
+	fake.objects[oid] = data
+	src := filepath.Join(t.TempDir(), "upload.tmp")
+	writeTestFile(t, src, data)
+
+	if err := store.upload(lfsPointer{Oid: oid, Size: int64(len(data))}, src); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.count("POST /objects/batch"); n != 1 {
+		t.Errorf("want one batch, got %d", n)
+	}
+	if n := fake.count("PUT ") + fake.count("POST /verify"); n != 0 {
+		t.Errorf("existing object should not be uploaded or verified, got %d requests", n)
+	}
+}
+
+func TestLFSDownloadHashMismatch(t *testing.T) {
+	fake := newFakeLFS(t)
+	store := newTestLFSStore(t, fake, t.TempDir())
+
+	data := randomBytes(t, 4096)
+	oid := sha256Hex(data)
+	fake.objects[oid] = data
+	fake.corrupt[oid] = randomBytes(t, 4096)
+
+	var buf bytes.Buffer
+	err := store.copyObject(lfsPointer{Oid: oid, Size: int64(len(data))}, &buf)
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("want ErrHashMismatch, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Error("corrupted content should not be written")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(store.cachePath(oid)))
+	if len(entries) != 0 {
+		t.Errorf("corrupted object left in cache: %v", entries)
+	}
+
+	delete(fake.corrupt, oid)
+	if err := store.copyObject(lfsPointer{Oid: oid, Size: int64(len(data))}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("content mismatch")
+	}
+}
+
+// 不走 Init, 不需要远程仓库和推送协程
+func newTestGitStorage(t *testing.T, fake *fakeLFS) (*GitStorage, *git.Worktree) {
+	workspace := t.TempDir()
+	repo, err := git.PlainInit(workspace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workTree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var storageCfg model.StorageConfig
+	storageCfg.DB.URL = filepath.Join(t.TempDir(), "data.db")
+	db, err := DBInit(storageCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &GitStorage{
+		cfg:  model.GitStorageConfig{GitWorkSpaceDir: workspace},
+		DB:   db,
+		repo: repo,
+		lfs:  newTestLFSStore(t, fake, workspace),
+	}, workTree
+}
+
+func commitAll(t *testing.T, workTree *git.Worktree, message string) {
+	if err := workTree.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := workTree.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 工作区里是指针, 本地缓存没有时从 LFS 下载
+func TestGitStorageGetLFSPointerInWorktree(t *testing.T) {
+	fake := newFakeLFS(t)
+	g, workTree := newTestGitStorage(t, fake)
+	ctx := context.Background()
+
+	data := randomBytes(t, 4096)
+	meta := model.NewMetaData(sha256Hex(data), "big.map")
+	meta.SetStorageStatus(model.MapUploadStatusSuccess, "")
+	if err := g.DB.Add(ctx, meta); err != nil {
+		t.Fatal(err)
+	}
+	fake.objects[meta.Hash] = data
+	relPath := repoMapPath(meta.Hash, meta.Name)
+	writeTestFile(t, filepath.Join(g.cfg.GitWorkSpaceDir, relPath), []byte(lfsPointer{Oid: meta.Hash, Size: 4096}.String()))
+	commitAll(t, workTree, "add pointer")
+
+	var buf bytes.Buffer
+	if _, err := g.Get(ctx, meta.Hash, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("content mismatch")
+	}
+	if !fileHasHash(g.lfs.cachePath(meta.Hash), meta.Hash) {
+		t.Error("downloaded object not cached")
+	}
+}
+
+// 工作区里已经是别的版本了, 从提交历史里找到指针
+func TestGitStorageGetLFSPointerInHistory(t *testing.T) {
+	fake := newFakeLFS(t)
+	g, workTree := newTestGitStorage(t, fake)
+	ctx := context.Background()
+
+	data := randomBytes(t, 4096)
+	meta := model.NewMetaData(sha256Hex(data), "big.map")
+	meta.SetStorageStatus(model.MapUploadStatusSuccess, "")
+	if err := g.DB.Add(ctx, meta); err != nil {
+		t.Fatal(err)
+	}
+	fake.objects[meta.Hash] = data
+	path := filepath.Join(g.cfg.GitWorkSpaceDir, repoMapPath(meta.Hash, meta.Name))
+	writeTestFile(t, path, []byte(lfsPointer{Oid: meta.Hash, Size: 4096}.String()))
+	commitAll(t, workTree, "add pointer")
+	other := sha256Hex([]byte("other"))
+	writeTestFile(t, path, []byte(lfsPointer{Oid: other, Size: 5}.String()))
+	commitAll(t, workTree, "overwrite pointer")
+
+	var buf bytes.Buffer
+	if _, err := g.Get(ctx, meta.Hash, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("content mismatch")
+	}
+	if n := fake.count("GET /objects/" + other); n != 0 {
+		t.Error("pointer with another oid should not be downloaded")
+	}
+}
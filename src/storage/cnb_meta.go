@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"map-storage-cnb/src/mapfile"
+	"map-storage-cnb/src/model"
+	"map-storage-cnb/src/utils"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+)
+
+// 仓库里的文件都按哈希命名, 不会因为同名地图冲突, 名字里的 ../ 之类也逃不出工作区.
+// 地图名字只出现在元数据文件和 INDEX.md 里
+const (
+	repoMapDir     = "maps"
+	repoMetaDir    = "meta"
+	repoPreviewDir = "preview"
+	repoIndexFile  = "INDEX.md"
+)
+
+// 写进仓库的元数据, 只保留用户关心的字段, 存储状态只在db里维护
+type repoMetaData struct {
+	Hash          string `json:"hash"`
+	CanonicalHash string `json:"canonical_hash"`
+	Name          string `json:"name"`
+	Size          uint64 `json:"size"`
+	CreateTime    int64  `json:"create_time"`
+	PrevHash      string `json:"prev_hash"`
+	Message       string `json:"message"`
+	Authors       string `json:"authors"`
+	MapType       string `json:"map_type"`
+
+	GameMode        string `json:"game_mode"`
+	MinPlayer       int    `json:"min_player"`
+	MaxPlayer       int    `json:"max_player"`
+	MultiplayerOnly bool   `json:"multiplayer_only"`
+	Mission         bool   `json:"mission"`
+}
+
+// maps/ab/<hash>.<ext>, 扩展名沿用地图名字里的, 不是地图扩展名时用 .map
+func repoMapPath(hash string, name string) string {
+	ext := ".map"
+	if mapfile.HasMapExt(name) {
+		ext = strings.ToLower(filepath.Ext(name))
+	}
+	return filepath.Join(repoMapDir, hash[:2], hash+ext)
+}
+
+// 按哈希存放之前地图直接以名字放在仓库根目录. 有类型的地图名字里已经带了正确的扩展名,
+// 类型检测之前上传的地图一律加过 .map
+func legacyRepoFilePath(name string, mapType model.MapType) string {
+	if mapType != "" {
+		return name
+	}
+	return utils.AddSuffixIfMissing(name, "map")
+}
+
+func repoMetaPath(hash string) string {
+	return filepath.Join(repoMetaDir, hash+".json")
+}
+
+func repoPreviewPath(hash string) string {
+	return filepath.Join(repoPreviewDir, previewFileName(hash))
+}
+
+func writeRepoMeta(dirPath string, meta *model.MapMetaData) error {
+	data, err := json.MarshalIndent(repoMetaData{
+		Hash:          meta.Hash,
+		CanonicalHash: meta.CanonicalHash,
+		Name:          meta.Name,
+		Size:          meta.Size,
+		CreateTime:    meta.CreateTime,
+		PrevHash:      meta.PrevHash,
+		Message:       meta.Message,
+		Authors:       meta.Authors,
+		MapType:       string(meta.MapType),
+
+		GameMode:        meta.GameMode,
+		MinPlayer:       meta.MinPlayer,
+		MaxPlayer:       meta.MaxPlayer,
+		MultiplayerOnly: meta.MultiplayerOnly,
+		Mission:         meta.Mission,
+	}, "", "    ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dirPath, repoMetaPath(meta.Hash))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func writeRepoPreview(dirPath string, hash string, tmpPath string, lfs *lfsStore) error {
+	path := filepath.Join(dirPath, repoPreviewPath(hash))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := lfs.place(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// 按顺序执行元数据修改: 改名改了扩展名就把地图文件挪到新的扩展名下, 再重写元数据文件.
+// 返回 INDEX.md 里显示的字段有没有变. 会动git索引, 调用方需要持有 repoLock
+func applyMetaUpdates(workTree *git.Worktree, dirPath string, batch []FileObj) bool {
+	indexChanged := false
+	for _, file := range batch {
+		if !indexChanged {
+			indexChanged = indexFieldsChanged(dirPath, file.Meta)
+		}
+		oldPath, newPath := repoMapPath(file.Hash, file.OldName), repoMapPath(file.Hash, file.Name)
+		if oldPath != newPath {
+			if err := moveRepoFile(workTree, dirPath, oldPath, newPath); err != nil {
+				log.Printf("failed to move %q to %q : %v", oldPath, newPath, err)
+			}
+		}
+		if err := writeRepoMeta(dirPath, file.Meta); err != nil {
+			log.Printf("failed to write metadata for %s : %v", file.Hash, err)
+		}
+	}
+	return indexChanged
+}
+
+// 和仓库里现有的元数据文件比较, 只改了描述之类不在 INDEX.md 里的字段时不用重新生成
+func indexFieldsChanged(dirPath string, meta *model.MapMetaData) bool {
+	data, err := os.ReadFile(filepath.Join(dirPath, repoMetaPath(meta.Hash)))
+	if err != nil {
+		return true
+	}
+	var old repoMetaData
+	if err := json.Unmarshal(data, &old); err != nil {
+		return true
+	}
+	return old.Name != meta.Name || old.Authors != meta.Authors
+}
+
+func moveRepoFile(workTree *git.Worktree, dirPath string, oldPath string, newPath string) error {
+	if err := os.Rename(filepath.Join(dirPath, oldPath), filepath.Join(dirPath, newPath)); err != nil {
+		return err
+	}
+	// 新路径交给 AddGlob, 旧路径要从索引里删掉; 还没提交过的文件本来就不在索引里
+	_, err := workTree.Remove(filepath.ToSlash(oldPath))
+	if errors.Is(err, index.ErrEntryNotFound) {
+		return nil
+	}
+	return err
+}
+
+// 从工作区和索引里删掉地图文件和元数据文件, 调用方需要持有 repoLock
+func applyDeletes(workTree *git.Worktree, dirPath string, batch []FileObj) []StorageFileMeta {
+	var result []StorageFileMeta
+	for _, file := range batch {
+		fileMeta := StorageFileMeta{
+			Op:       FileOpDelete,
+			Filename: file.Name,
+			Hash:     file.Hash,
+			Status:   model.MapUploadStatusSuccess,
+			Reason:   model.MapUploadStatusMsgSuccess,
+		}
+		err := removeRepoFile(workTree, dirPath, repoMapPath(file.Hash, file.Name))
+		if err == nil {
+			err = removeRepoFile(workTree, dirPath, repoMetaPath(file.Hash))
+		}
+		if err == nil {
+			err = removeRepoFile(workTree, dirPath, repoPreviewPath(file.Hash))
+		}
+		if err != nil {
+			fileMeta.Status = model.MapDeleteStatusFailed
+			fileMeta.Reason = fmt.Sprintf("failed to delete %q: %v", file.Name, err)
+		}
+		result = append(result, fileMeta)
+	}
+	return result
+}
+
+func removeRepoFile(workTree *git.Worktree, dirPath string, relPath string) error {
+	_, err := workTree.Remove(filepath.ToSlash(relPath))
+	if errors.Is(err, index.ErrEntryNotFound) {
+		// 还没提交过, 只在工作区里
+		err = os.Remove(filepath.Join(dirPath, relPath))
+		if os.IsNotExist(err) {
+			return nil
+		}
+	}
+	return err
+}
+
+// 按 meta 目录里的元数据重新生成 INDEX.md, 按名字排序, 在仓库网页上就能按名字找到地图
+func writeRepoIndex(dirPath string) error {
+	entries, err := os.ReadDir(filepath.Join(dirPath, repoMetaDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var metas []repoMetaData
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dirPath, repoMetaDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		var meta repoMetaData
+		if err := json.Unmarshal(data, &meta); err != nil || len(meta.Hash) < 2 {
+			log.Printf("skip invalid metadata file %q in index : %v", entry.Name(), err)
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	slices.SortFunc(metas, func(a, b repoMetaData) int {
+		return cmp.Or(strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)), cmp.Compare(a.CreateTime, b.CreateTime))
+	})
+
+	var b strings.Builder
+	b.WriteString("# Map Index\n\n")
+	fmt.Fprintf(&b, "%d maps. Generated from %s/, do not edit.\n\n", len(metas), repoMetaDir)
+	b.WriteString("| Name | Authors | Type | Players | Uploaded | File |\n")
+	b.WriteString("| --- | --- | --- | --- | --- | --- |\n")
+	for _, meta := range metas {
+		players := ""
+		if meta.MaxPlayer > 0 {
+			players = fmt.Sprintf("%d-%d", meta.MinPlayer, meta.MaxPlayer)
+		}
+		path := filepath.ToSlash(repoMapPath(meta.Hash, meta.Name))
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | [%s](%s) |\n",
+			indexCell(meta.Name), indexCell(meta.Authors), meta.MapType, players,
+			time.Unix(0, meta.CreateTime).UTC().Format(time.DateOnly), meta.Hash[:12], path)
+	}
+	return os.WriteFile(filepath.Join(dirPath, repoIndexFile), []byte(b.String()), 0644)
+}
+
+// 表格里的 | 和换行会破坏格式
+func indexCell(value string) string {
+	value = strings.ReplaceAll(value, "|", "\\|")
+	return strings.Join(strings.Fields(value), " ")
+}
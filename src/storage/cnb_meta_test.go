@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"testing"
+
+	"map-storage-cnb/src/model"
+)
+
+// 只改描述不用重新生成 INDEX.md, 改名字作者或者没有旧文件时要生成
+func TestIndexFieldsChanged(t *testing.T) {
+	dirPath := t.TempDir()
+	meta := model.NewMetaData("abc", "a.map")
+	meta.Authors = "x"
+	if !indexFieldsChanged(dirPath, &meta) {
+		t.Error("missing metadata file should count as changed")
+	}
+	if err := writeRepoMeta(dirPath, &meta); err != nil {
+		t.Fatal(err)
+	}
+
+	meta.Message = "new description"
+	if indexFieldsChanged(dirPath, &meta) {
+		t.Error("message is not in the index")
+	}
+	meta.Name = "b.map"
+	if !indexFieldsChanged(dirPath, &meta) {
+		t.Error("name change should regenerate the index")
+	}
+	meta.Name = "a.map"
+	meta.Authors = "y"
+	if !indexFieldsChanged(dirPath, &meta) {
+		t.Error("authors change should regenerate the index")
+	}
+}
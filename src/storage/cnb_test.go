@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"map-storage-cnb/src/model"
+)
+
+// 关闭时推送协程还在处理一批, 最终状态要写进db, 不能往关闭的通道发送
+func TestGitStorageCloseDuringPush(t *testing.T) {
+	t.Chdir(t.TempDir())
+	g, workTree := newTestGitStorage(t, newFakeLFS(t))
+	g.lfs = nil
+	g.cfg.MaxPushFileAtOnce = 10
+	g.cfg.WriteFileWorkers = 2
+	g.ctx, g.ctxCancel = context.WithCancel(context.Background())
+	g.fileChan = make(chan FileObj, g.cfg.MaxPushFileAtOnce*2)
+	g.StorageFileMetaChan = make(chan StorageFileMeta, 1)
+	g.statusHub = NewStatusHub()
+	g.startPushService(g.repo, workTree)
+
+	ctx := context.Background()
+	data := randomBytes(t, 256)
+	meta := model.NewMetaData(sha256Hex(data), "a.map")
+	if _, err := g.Save(ctx, meta, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	g.ctxCancel()
+	g.wg.Wait()
+
+	// 没有远程仓库, 推送失败
+	record, err := g.DB.Get(ctx, meta.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.StorageStatus != model.MapUploadStatusFailed {
+		t.Errorf("status = %v, want failed", record.StorageStatus)
+	}
+	if _, ok := <-g.StorageFileMetaChan; ok {
+		t.Error("StorageFileMetaChan should be closed")
+	}
+	close(g.fileChan)
+}
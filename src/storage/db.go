@@ -2,14 +2,32 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"map-storage-cnb/src/model"
 
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+const (
+	MaxSearchLimit      = 100
+	DefaultHistoryLimit = 20
+	MaxHistoryLimit     = 100
+)
+
+// 转义 LIKE 里的通配符, 配合 ESCAPE '\' 使用, 让用户输入的 % _ 按字面匹配
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func likeContains(keyword string) string {
+	return "%" + likeEscaper.Replace(keyword) + "%"
+}
+
 type StorageDB struct {
 	cfg model.StorageDBConfig
 	DB  *gorm.DB
@@ -26,6 +44,13 @@ func DBInit(cfg model.StorageConfig) (*StorageDB, error) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// 加 classified 列之前已经有人数的地图肯定解析过了, 不用再取文件
+	err = db.Model(&model.MapMetaData{}).
+		Where("classified = ? AND max_player > 0", false).
+		Update("classified", true).Error
+	if err != nil {
+		return nil, err
+	}
 	return &StorageDB{DB: db, cfg: cfg.DB}, nil
 
 }
@@ -45,12 +70,58 @@ func (s *StorageDB) Update(ctx context.Context, metaData model.MapMetaData) erro
 		Updates(&metaData).Error
 }
 
+// 只更新用户可修改的字段, 地图不存在时返回 ErrMapNotFound
+func (s *StorageDB) UpdateFields(ctx context.Context, hash string, update model.MapMetaDataUpdate) error {
+	columns := update.Columns()
+	if len(columns) == 0 {
+		return nil
+	}
+	result := s.DB.WithContext(ctx).
+		Model(&model.MapMetaData{}).
+		Where("hash = ?", hash).
+		Updates(columns)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w : %s", ErrMapNotFound, hash)
+	}
+	return nil
+}
+
+// 只更新存储状态. MapUploadStatusSuccess 是零值, 用 Update 会被跳过, 所以这里用map
+func (s *StorageDB) UpdateStatus(ctx context.Context, hash string, status model.MapStorageStatus, msg string) error {
+	return s.DB.WithContext(ctx).
+		Model(&model.MapMetaData{}).
+		Where("hash = ?", hash).
+		Updates(map[string]any{"storage_status": status, "storage_status_msg": msg}).Error
+}
+
 func (s *StorageDB) Get(ctx context.Context, hash string) (*model.MapMetaData, error) {
 	var result model.MapMetaData
 	err := s.DB.WithContext(ctx).
 		Where("hash = ?", hash).
 		First(&result).Error // 找到第一条记录
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w : %s", ErrMapNotFound, hash)
+		}
+		return nil, err
+	}
+	return &result, nil
+}
+
+// 规范化哈希相同的地图里最早上传的那个
+func (s *StorageDB) GetByCanonicalHash(ctx context.Context, canonicalHash string) (*model.MapMetaData, error) {
+	var result model.MapMetaData
+	err := s.DB.WithContext(ctx).
+		Where("canonical_hash = ?", canonicalHash).
+		Order("create_time ASC").
+		First(&result).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w : canonical hash %s", ErrMapNotFound, canonicalHash)
+		}
 		return nil, err
 	}
 	return &result, nil
@@ -63,7 +134,7 @@ func (s *StorageDB) Search(ctx context.Context, keyword string, limit int) ([]mo
 	}
 	var result []model.MapMetaData
 	err := s.DB.WithContext(ctx).
-		Where("name LIKE ?", "%"+keyword+"%").
+		Where(`name LIKE ? ESCAPE '\'`, likeContains(keyword)).
 		Limit(limit).
 		Find(&result).Error
 	return result, err
@@ -82,6 +153,124 @@ func (s *StorageDB) SearchExact(ctx context.Context, keyword string, limit int)
 	return result, err
 }
 
+// 按 MapMetaDataSearch 组合查询, 默认查10个, 最多 MaxSearchLimit 个, 按上传时间排序
+func (s *StorageDB) SearchMeta(ctx context.Context, search model.MapMetaDataSearch) ([]model.MapMetaData, error) {
+	limit := int(search.Limit)
+	if limit <= 0 {
+		limit = 10
+	}
+	limit = min(limit, MaxSearchLimit)
+
+	query := s.DB.WithContext(ctx)
+	if search.Hash != nil {
+		query = query.Where("hash = ?", *search.Hash)
+	}
+	if search.Name != nil {
+		query = query.Where(`name LIKE ? ESCAPE '\'`, likeContains(*search.Name))
+	}
+	if search.MinSize != nil {
+		query = query.Where("size >= ?", *search.MinSize)
+	}
+	if search.MaxSize != nil {
+		query = query.Where("size <= ?", *search.MaxSize)
+	}
+	if search.StartTime != nil {
+		query = query.Where("create_time >= ?", *search.StartTime)
+	}
+	if search.EndTime != nil {
+		query = query.Where("create_time <= ?", *search.EndTime)
+	}
+	if search.PrevHash != nil {
+		query = query.Where("prev_hash = ?", *search.PrevHash)
+	}
+	if search.Message != nil {
+		query = query.Where(`message LIKE ? ESCAPE '\'`, likeContains(*search.Message))
+	}
+	if search.Authors != nil {
+		for _, author := range strings.Split(*search.Authors, ",") {
+			if author = strings.TrimSpace(author); author != "" {
+				query = query.Where(`authors LIKE ? ESCAPE '\'`, likeContains(author))
+			}
+		}
+	}
+	if search.MapType != nil {
+		query = query.Where("map_type = ?", *search.MapType)
+	}
+	if search.CanonicalHash != nil {
+		query = query.Where("canonical_hash = ?", *search.CanonicalHash)
+	}
+	if search.GameMode != nil {
+		// 两边补上逗号, 避免 war 匹配到 navalwar
+		for _, mode := range strings.Split(*search.GameMode, ",") {
+			if mode = strings.ToLower(strings.TrimSpace(mode)); mode != "" {
+				query = query.Where(`(',' || game_mode || ',') LIKE ? ESCAPE '\'`, likeContains(","+mode+","))
+			}
+		}
+	}
+	if search.Players != nil {
+		query = query.Where("min_player <= ? AND max_player >= ?", *search.Players, *search.Players)
+	}
+	// 地图支持的人数范围和 [min_player, max_player] 有交集
+	if search.MinPlayer != nil {
+		query = query.Where("max_player >= ?", *search.MinPlayer)
+	}
+	if search.MaxPlayer != nil {
+		query = query.Where("min_player <= ?", *search.MaxPlayer)
+	}
+	if search.MultiplayerOnly != nil {
+		query = query.Where("multiplayer_only = ?", *search.MultiplayerOnly)
+	}
+	if search.Mission != nil {
+		query = query.Where("mission = ?", *search.Mission)
+	}
+
+	order := "create_time ASC"
+	if search.OrderDesc {
+		order = "create_time DESC"
+	}
+
+	var result []model.MapMetaData
+	err := query.
+		Order(order).
+		Limit(limit).
+		Find(&result).Error
+	return result, err
+}
+
+// 沿 PrevHash 往前找版本, 最多 limit 个, 遇到环或者断链就停下返回已经找到的部分.
+// 只有起点本身不存在时才返回 ErrMapNotFound
+func (s *StorageDB) History(ctx context.Context, hash string, limit int) (*model.MapHistory, error) {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	limit = min(limit, MaxHistoryLimit)
+
+	history := &model.MapHistory{}
+	visited := make(map[string]bool)
+	for hash != "" {
+		if visited[hash] {
+			history.CycleAt = hash
+			break
+		}
+		if len(history.Versions) >= limit {
+			history.Truncated = true
+			break
+		}
+		metaData, err := s.Get(ctx, hash)
+		if err != nil {
+			if errors.Is(err, ErrMapNotFound) && len(history.Versions) > 0 {
+				history.BrokenLink = hash
+				break
+			}
+			return nil, err
+		}
+		visited[hash] = true
+		history.Versions = append(history.Versions, *metaData)
+		hash = metaData.PrevHash
+	}
+	return history, nil
+}
+
 // 列出元数据
 func (s *StorageDB) List(ctx context.Context, page int, desc bool, orderField string, limit int) ([]model.MapMetaData, error) {
 	if limit <= 0 {
@@ -103,6 +292,17 @@ func (s *StorageDB) List(ctx context.Context, page int, desc bool, orderField st
 		Find(&result).Error
 	return result, err
 }
+
+// 某个存储状态的全部地图, 启动时的迁移用
+func (s *StorageDB) ListByStatus(ctx context.Context, status model.MapStorageStatus) ([]model.MapMetaData, error) {
+	var result []model.MapMetaData
+	err := s.DB.WithContext(ctx).
+		Where("storage_status = ?", status).
+		Order("create_time ASC").
+		Find(&result).Error
+	return result, err
+}
+
 func (s *StorageDB) Close() error {
 	db, err := s.DB.DB()
 	if err != nil {
@@ -110,3 +310,82 @@ func (s *StorageDB) Close() error {
 	}
 	return db.Close()
 }
+
+// 复合存储的副本状态表, 放在主存储的db里
+func (s *StorageDB) MigrateReplicas() error {
+	return s.DB.AutoMigrate(&model.MapReplica{})
+}
+
+// 设置副本状态, 失败时累加重试次数, 其它状态清零
+func (s *StorageDB) SetReplicaStatus(ctx context.Context, hash string, backend model.StorageType, status model.ReplicaStatus, msg string) error {
+	attempts := gorm.Expr("0")
+	if status == model.ReplicaStatusFailed {
+		attempts = gorm.Expr("attempts + 1")
+	}
+	replica := model.MapReplica{Hash: hash, Backend: backend, Status: status, Msg: msg, UpdateTime: time.Now().UnixNano()}
+	if status == model.ReplicaStatusFailed {
+		replica.Attempts = 1
+	}
+	return s.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "hash"}, {Name: "backend"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"status": status, "msg": msg, "attempts": attempts, "update_time": replica.UpdateTime,
+		}),
+	}).Create(&replica).Error
+}
+
+func (s *StorageDB) DeleteReplica(ctx context.Context, hash string, backend model.StorageType) error {
+	return s.DB.WithContext(ctx).Delete(&model.MapReplica{}, "hash = ? AND backend = ?", hash, backend).Error
+}
+
+func (s *StorageDB) Replicas(ctx context.Context, hash string) ([]model.MapReplica, error) {
+	var result []model.MapReplica
+	err := s.DB.WithContext(ctx).Where("hash = ?", hash).Order("backend").Find(&result).Error
+	return result, err
+}
+
+// 还没同步成功, 并且失败次数没有超过 maxAttempts 的副本, 最早更新的在前
+func (s *StorageDB) UnsyncedReplicas(ctx context.Context, maxAttempts uint, limit int) ([]model.MapReplica, error) {
+	var result []model.MapReplica
+	err := s.DB.WithContext(ctx).
+		Where("status <> ? AND attempts < ?", model.ReplicaStatusSynced, maxAttempts).
+		Order("update_time ASC").
+		Limit(limit).
+		Find(&result).Error
+	return result, err
+}
+
+// 给 backend 上还没有记录的地图补上 pending 记录, 启用副本之前已经存在的地图靠这个复制过去
+func (s *StorageDB) BackfillReplicas(ctx context.Context, backend model.StorageType) (int64, error) {
+	result := s.DB.WithContext(ctx).Exec(
+		"INSERT INTO map_replicas (hash, backend, status, msg, attempts, update_time) "+
+			"SELECT hash, ?, ?, '', 0, ? FROM map_meta_data "+
+			"WHERE hash NOT IN (SELECT hash FROM map_replicas WHERE backend = ?)",
+		backend, model.ReplicaStatusPending, time.Now().UnixNano(), backend)
+	return result.RowsAffected, result.Error
+}
+
+// 加上分类字段之前存的地图 max_player 都是0, 按 hash 翻页找出来重新解析
+func (s *StorageDB) ListUnclassified(ctx context.Context, afterHash string, limit int) ([]model.MapMetaData, error) {
+	var result []model.MapMetaData
+	err := s.DB.WithContext(ctx).
+		Where("classified = ? AND hash > ?", false, afterHash).
+		Order("hash").
+		Limit(limit).
+		Find(&result).Error
+	return result, err
+}
+
+// 只写地图分类相关的列
+func (s *StorageDB) UpdateClassification(ctx context.Context, meta *model.MapMetaData) error {
+	return s.DB.WithContext(ctx).Model(&model.MapMetaData{}).
+		Where("hash = ?", meta.Hash).
+		Updates(map[string]any{
+			"game_mode":        meta.GameMode,
+			"min_player":       meta.MinPlayer,
+			"max_player":       meta.MaxPlayer,
+			"multiplayer_only": meta.MultiplayerOnly,
+			"mission":          meta.Mission,
+			"classified":       true,
+		}).Error
+}
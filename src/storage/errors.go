@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"map-storage-cnb/src/model"
+)
+
+var (
+	ErrMapNotFound  = errors.New("map not found")
+	ErrMapExists    = errors.New("map already exists")
+	ErrHashMismatch = errors.New("sha256 mismatch")
+
+	ErrPreviewNotFound = errors.New("preview not found")
+
+	// 字节不同但规范化之后和已有地图一样, errors.Is(err, ErrMapExists) 同样成立
+	ErrMapDuplicate = fmt.Errorf("%w with equivalent content", ErrMapExists)
+)
+
+// 元数据在, 但文件还读不到: 还在推送中或者存储失败了.
+// errors.Is(err, ErrMapNotFound) 同样成立
+type MapNotReadyError struct {
+	Hash   string
+	Status model.MapStorageStatus
+	Reason string
+}
+
+func (e *MapNotReadyError) Error() string {
+	return fmt.Sprintf("map %s is not ready : %s", e.Hash, e.Reason)
+}
+
+func (e *MapNotReadyError) Unwrap() error {
+	return ErrMapNotFound
+}
@@ -2,24 +2,50 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"map-storage-cnb/src/model"
 )
 
+// 按类型创建存储, 还需要调用 Init
+func New(storageType model.StorageType) (Interface, error) {
+	switch storageType {
+	case StorageTypeLocalStorage:
+		return NewLocalStorage(), nil
+	case StorageTypeGitStorage:
+		return NewGitStorage(), nil
+	case StorageTypeS3Storage:
+		return NewS3Storage(), nil
+	case StorageTypeReplicatedStorage:
+		return NewReplicatedStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", storageType)
+	}
+}
+
 type Interface interface {
 	Init(cfg model.StorageConfig) error
 
 	Close() error
 
-	// 写：从 reader 读直到 EOF 并计算哈希，返回最终 Meta
-	Save(ctx context.Context, metaData model.MapMetaData, data []byte) (*model.MapMetaData, error)
+	// 写：从 reader 读直到 EOF 并计算哈希，返回最终 Meta.
+	// metaData.Hash 非空时会和算出来的哈希比对, 不一致返回 ErrHashMismatch;
+	// 已经存在相同哈希时返回已有的 Meta 和 ErrMapExists
+	Save(ctx context.Context, metaData model.MapMetaData, reader io.Reader) (*model.MapMetaData, error)
 
 	// 读：把文件内容 copy 到 writer
 	Get(ctx context.Context, hash string, writer io.Writer) (*model.MapMetaData, error)
 
 	GetMeta(ctx context.Context, hash string) (*model.MapMetaData, error)
 
-	GetHistory(ctx context.Context, hash string, limit int) ([]model.MapMetaData, error)
+	// 读上传时从地图里解出来的png预览图, 地图本身没有预览图时返回 ErrPreviewNotFound
+	GetPreview(ctx context.Context, hash string, writer io.Writer) error
+
+	// 沿 PrevHash 列出历史版本, 会处理 limit, 环和断链
+	GetHistory(ctx context.Context, hash string, limit int) (*model.MapHistory, error)
+
+	// 修改用户可编辑的元数据, 返回修改后的 Meta
+	Update(ctx context.Context, hash string, update model.MapMetaDataUpdate) (*model.MapMetaData, error)
 
 	// 是否存在
 	Exists(ctx context.Context, hash string) (bool, error)
@@ -30,9 +56,39 @@ type Interface interface {
 	// 模糊查询（LIKE %name%）
 	Search(ctx context.Context, name string, limit int) ([]model.MapMetaData, error)
 
+	// 组合条件查询
+	SearchMeta(ctx context.Context, search model.MapMetaDataSearch) ([]model.MapMetaData, error)
+
 	// 列举
 	List(ctx context.Context, page int, desc bool, orderField string, limit int) ([]model.MapMetaData, error)
 
 	// 删除
 	Delete(ctx context.Context, hash string) error
 }
+
+// 异步写入的存储(例如git)实现这个接口, 可以订阅写入进度
+type StatusNotifier interface {
+	// 订阅 hash 的状态变化, hash 为空订阅全部, 返回的函数用来取消订阅
+	SubscribeStatus(hash string) (<-chan model.MapStatusEvent, func())
+
+	// 还在处理中的地图最近一次的状态, 已经结束的以db为准
+	LatestStatus(hash string) (model.MapStatusEvent, bool)
+}
+
+// 可以把多次写入合并成一次提交的存储(例如git)实现这个接口
+type BatchSaver interface {
+	NewBatch() SaveBatch
+}
+
+type SaveBatch interface {
+	// 和 Interface.Save 一样, 但是要等 Commit 之后才真正提交
+	Save(ctx context.Context, metaData model.MapMetaData, reader io.Reader) (*model.MapMetaData, error)
+
+	// 把这一批写入作为一个整体提交, 没有写入时什么都不做
+	Commit()
+}
+
+// 带副本的存储实现这个接口, 可以查询每个副本的同步状态
+type ReplicaReporter interface {
+	ReplicaStatus(ctx context.Context, hash string) ([]model.MapReplica, error)
+}
@@ -3,15 +3,13 @@ package storage
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
-	"map-storage-cnb/src/config"
 	"map-storage-cnb/src/model"
 	"map-storage-cnb/src/utils"
 	"os"
 	"path/filepath"
-
-	"gorm.io/gorm"
 )
 
 const (
@@ -19,12 +17,9 @@ const (
 )
 
 type LocalStorage struct {
-	cfg model.LocalStorageConfig
-	DB  *StorageDB
-}
-
-func joinTmpPath(name string) string {
-	return filepath.Join(config.LocalStorageDir, name)
+	cfg    model.LocalStorageConfig
+	layout shardLayout
+	DB     *StorageDB
 }
 
 func NewLocalStorage() *LocalStorage {
@@ -33,7 +28,24 @@ func NewLocalStorage() *LocalStorage {
 
 func (g *LocalStorage) Init(cfg model.StorageConfig) error {
 	g.cfg = cfg.LocalStorage
+	depth := defaultShardDepth
+	if g.cfg.ShardDepth != nil {
+		depth = *g.cfg.ShardDepth
+	}
+	if depth < 0 || depth > maxShardDepth {
+		return fmt.Errorf("LocalStorage.ShardDepth must between 0 and %d", maxShardDepth)
+	}
 	utils.InitDefaultDir()
+	if err := os.MkdirAll(g.cfg.Path, 0755); err != nil {
+		return err
+	}
+	if err := migrateLayout(g.cfg.Path, depth); err != nil {
+		return err
+	}
+	if err := migrateLegacyDir(g.cfg.Path, depth); err != nil {
+		return err
+	}
+	g.layout = shardLayout{root: g.cfg.Path, depth: depth}
 	db, err := DBInit(cfg)
 	if err != nil {
 		log.Fatal(err)
@@ -41,21 +53,47 @@ func (g *LocalStorage) Init(cfg model.StorageConfig) error {
 	g.DB = db
 	return nil
 }
+func (g *LocalStorage) metaDB() *StorageDB {
+	return g.DB
+}
+
 func (s *LocalStorage) Close() error {
 	s.DB.Close()
 	return nil
 }
 
-func (g *LocalStorage) Save(ctx context.Context, metaData model.MapMetaData, data []byte) (*model.MapMetaData, error) {
+func (g *LocalStorage) Save(ctx context.Context, metaData model.MapMetaData, reader io.Reader) (*model.MapMetaData, error) {
+	// 临时文件放在存储根目录, 和分片目录在同一个文件系统, rename 是原子的
+	spooled, err := SpoolToTemp(g.cfg.Path, reader)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Path) // rename 成功之后这里什么都不做
+
+	existing, err := acceptSpooled(ctx, g.DB, &metaData, spooled)
+	if err != nil {
+		return existing, err
+	}
+
 	metaData.SetStorageType(StorageTypeLocalStorage)
-	if err := os.WriteFile(joinTmpPath(metaData.Hash), data, 0655); err != nil {
+	mapPath := g.layout.path(metaData.Hash, metaData.Hash)
+	if err := os.MkdirAll(filepath.Dir(mapPath), 0755); err != nil {
 		return nil, err
 	}
+	if err := os.Rename(spooled.Path, mapPath); err != nil {
+		return nil, err
+	}
+	if preview := spoolPreview(g.cfg.Path, mapPath); preview != "" {
+		if err := os.Rename(preview, g.layout.path(metaData.Hash, previewFileName(metaData.Hash))); err != nil {
+			log.Printf("save preview of %s failed : %v", metaData.Hash, err)
+			os.Remove(preview)
+		}
+	}
 	metaData.SetStorageStatus(model.MapUploadStatusSuccess, "")
 	if err := g.DB.Add(ctx, metaData); err != nil {
 		return nil, err
 	}
-	return nil, nil
+	return &metaData, nil
 }
 
 func (g *LocalStorage) Get(ctx context.Context, hash string, writer io.Writer) (*model.MapMetaData, error) {
@@ -63,7 +101,7 @@ func (g *LocalStorage) Get(ctx context.Context, hash string, writer io.Writer) (
 	if err != nil {
 		return nil, err
 	}
-	file, err := os.Open(joinTmpPath(hash))
+	file, err := os.Open(g.layout.path(hash, hash))
 	if err != nil {
 		return nil, err
 	}
@@ -77,6 +115,22 @@ func (g *LocalStorage) Get(ctx context.Context, hash string, writer io.Writer) (
 	return metaData, nil
 }
 
+func (g *LocalStorage) GetPreview(ctx context.Context, hash string, writer io.Writer) error {
+	if _, err := g.DB.Get(ctx, hash); err != nil {
+		return err
+	}
+	file, err := os.Open(g.layout.path(hash, previewFileName(hash)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w : %s", ErrPreviewNotFound, hash)
+		}
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
+}
+
 func (g *LocalStorage) GetMeta(ctx context.Context, hash string) (*model.MapMetaData, error) {
 	metaData, err := g.DB.Get(ctx, hash)
 	if err != nil {
@@ -85,26 +139,21 @@ func (g *LocalStorage) GetMeta(ctx context.Context, hash string) (*model.MapMeta
 	return metaData, nil
 }
 
-func (g *LocalStorage) GetHistory(ctx context.Context, hash string, limit int) ([]model.MapMetaData, error) {
-	var result []model.MapMetaData
-	for {
-		metaData, err := g.DB.Get(ctx, hash)
-		if err != nil {
-			return nil, err
-		}
-		result = append(result, *metaData)
-		hash = metaData.PrevHash
-		if hash == "" {
-			break
-		}
+func (g *LocalStorage) Update(ctx context.Context, hash string, update model.MapMetaDataUpdate) (*model.MapMetaData, error) {
+	if err := g.DB.UpdateFields(ctx, hash, update); err != nil {
+		return nil, err
 	}
-	return result, nil
+	return g.DB.Get(ctx, hash)
+}
+
+func (g *LocalStorage) GetHistory(ctx context.Context, hash string, limit int) (*model.MapHistory, error) {
+	return g.DB.History(ctx, hash, limit)
 }
 
 func (g *LocalStorage) Exists(ctx context.Context, hash string) (bool, error) {
 	_, err := g.DB.Get(ctx, hash)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		if errors.Is(err, ErrMapNotFound) {
 			return false, nil
 		}
 		return false, err
@@ -125,16 +174,25 @@ func (g *LocalStorage) Search(ctx context.Context, name string, limit int) ([]mo
 	return result, nil
 }
 
+func (g *LocalStorage) SearchMeta(ctx context.Context, search model.MapMetaDataSearch) ([]model.MapMetaData, error) {
+	return g.DB.SearchMeta(ctx, search)
+}
+
 func (g *LocalStorage) List(ctx context.Context, page int, desc bool, orderField string, limit int) ([]model.MapMetaData, error) {
 	return g.DB.List(ctx, page, desc, orderField, limit)
 }
 
 func (g *LocalStorage) Delete(ctx context.Context, hash string) error {
-	err := os.Remove(joinTmpPath(hash))
-	if err != nil {
+	if _, err := g.DB.Get(ctx, hash); err != nil {
 		return err
 	}
-	err = g.DB.Delete(ctx, hash)
+	for _, name := range []string{hash, previewFileName(hash)} {
+		err := os.Remove(g.layout.path(hash, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := g.DB.Delete(ctx, hash)
 	if err != nil {
 		return err
 	}
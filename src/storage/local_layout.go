@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 记录当前目录布局的分片层数, 没有这个文件说明是分片之前的平铺目录
+	localLayoutFile   = ".layout"
+	defaultShardDepth = 2
+	maxShardDepth     = 4
+	// 以前不管配置的 Path 是什么, 地图都平铺在这里
+	legacyLocalDir = "./uploads"
+)
+
+// 按哈希分片的目录布局, depth 层, 每层取哈希的两个字符: depth=2 时是 ab/cd/<hash>
+type shardLayout struct {
+	root  string
+	depth int
+}
+
+// 文件名以地图哈希开头(地图本身和 .png 预览图), 分片按地图哈希算
+func (l shardLayout) path(hash string, name string) string {
+	parts := []string{l.root}
+	for i := 0; i < l.depth && len(hash) >= (i+1)*2; i++ {
+		parts = append(parts, hash[i*2:i*2+2])
+	}
+	return filepath.Join(append(parts, name)...)
+}
+
+func readLayoutDepth(root string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(root, localLayoutFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	depth, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s : %w", localLayoutFile, err)
+	}
+	return depth, nil
+}
+
+func writeLayoutDepth(root string, depth int) error {
+	return os.WriteFile(filepath.Join(root, localLayoutFile), []byte(strconv.Itoa(depth)+"\n"), 0644)
+}
+
+// 存储文件名对应的地图哈希, 不是存储文件(例如临时文件)返回 false
+func storedFileHash(name string) (string, bool) {
+	hash := strings.TrimSuffix(name, ".png")
+	if len(hash) != 64 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", false
+	}
+	return hash, true
+}
+
+// 分片层数和目录里记录的不一样时把所有文件搬到新的位置, 只在启动时跑一次.
+// 每个文件都是 rename, 中途退出下次启动会接着搬, 全部搬完才更新 .layout
+func migrateLayout(root string, depth int) error {
+	current, err := readLayoutDepth(root)
+	if err != nil {
+		return err
+	}
+	if current == depth {
+		return nil
+	}
+	log.Printf("migrating %q from shard depth %d to %d", root, current, depth)
+
+	target := shardLayout{root: root, depth: depth}
+	moved := 0
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		hash, ok := storedFileHash(entry.Name())
+		if !ok {
+			return nil
+		}
+		dst := target.path(hash, entry.Name())
+		if dst == path {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(path, dst); err != nil {
+			return err
+		}
+		moved++
+		if moved%1000 == 0 {
+			log.Printf("migrated %d files", moved)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("migrate %q failed after %d files : %w", root, moved, err)
+	}
+	removeEmptyDirs(root)
+	log.Printf("migrated %d files in %q", moved, root)
+	return writeLayoutDepth(root, depth)
+}
+
+// Path 不是 ./uploads 时, 把以前写在 ./uploads 里的文件搬到 Path 下的分片目录.
+// 每次启动都检查一次, Path 下已经有的不覆盖, 旧目录搬空了就删掉
+func migrateLegacyDir(root string, depth int) error {
+	legacy, err := filepath.Abs(legacyLocalDir)
+	if err != nil {
+		return err
+	}
+	current, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	if legacy == current {
+		return nil
+	}
+	entries, err := os.ReadDir(legacy)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	target := shardLayout{root: root, depth: depth}
+	moved := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		hash, ok := storedFileHash(entry.Name())
+		if !ok {
+			continue
+		}
+		dst := target.path(hash, entry.Name())
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := moveFile(filepath.Join(legacy, entry.Name()), dst); err != nil {
+			return fmt.Errorf("migrate %q failed after %d files : %w", legacy, moved, err)
+		}
+		moved++
+	}
+	if moved > 0 {
+		log.Printf("migrated %d files from %q to %q", moved, legacy, root)
+	}
+	os.Remove(legacy) // 还有别的文件时会失败, 正好留下
+	return nil
+}
+
+// 搬完之后旧的分片目录是空的, 从深到浅删掉
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i]) // 不是空目录会失败, 正好留下
+	}
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"errors"
+	"image/png"
+	"log"
+	"os"
+
+	"map-storage-cnb/src/mapfile"
+)
+
+// 预览图和地图放在一起, 按地图的哈希命名
+func previewFileName(hash string) string {
+	return hash + ".png"
+}
+
+// 从落盘的地图里解出预览图, 编码成png写到 dir 下的临时文件.
+// 预览图只是附带的, 不是地图, 没有预览图或者解码失败都只返回空路径, 不影响地图本身的存储
+func spoolPreview(dir string, mapPath string) string {
+	file, err := os.Open(mapPath)
+	if err != nil {
+		log.Printf("open %q for preview failed : %v", mapPath, err)
+		return ""
+	}
+	defer file.Close()
+
+	ini, err := mapfile.ParseINI(file)
+	if err != nil {
+		return ""
+	}
+	img, err := mapfile.Preview(ini)
+	if err != nil {
+		if !errors.Is(err, mapfile.ErrNoPreview) {
+			log.Printf("decode preview of %q failed : %v", mapPath, err)
+		}
+		return ""
+	}
+
+	tmp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		log.Printf("create preview file failed : %v", err)
+		return ""
+	}
+	err = png.Encode(tmp, img)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("encode preview of %q failed : %v", mapPath, err)
+		os.Remove(tmp.Name())
+		return ""
+	}
+	return tmp.Name()
+}
@@ -0,0 +1,602 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mapConfig "map-storage-cnb/src/config"
+	"map-storage-cnb/src/model"
+)
+
+const (
+	StorageTypeReplicatedStorage model.StorageType = "ReplicatedStorage"
+
+	replicaScanLimit = 500
+)
+
+// 从主存储取文件复制到副本时的临时目录
+var replicaSpoolDir = filepath.Join(mapConfig.UploadTmpDir, "replica_spool")
+
+// 各个存储都把元数据放在 StorageDB 里, 副本状态表借用主存储的连接
+type metaDBHolder interface {
+	metaDB() *StorageDB
+}
+
+type replicaBackend struct {
+	storageType model.StorageType
+	storage     Interface
+}
+
+type replicaJob struct {
+	hash    string
+	backend model.StorageType
+}
+
+// 写主存储, 异步复制到副本; 元数据查询只走主存储, 读文件按 ReadOrder 依次回退
+type ReplicatedStorage struct {
+	cfg       model.ReplicatedStorageConfig
+	primary   replicaBackend
+	replicas  []replicaBackend
+	readOrder []replicaBackend
+	DB        *StorageDB // 主存储的db
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	wg        sync.WaitGroup
+	jobs      chan replicaJob
+	runningMu sync.Mutex
+	running   map[replicaJob]bool // 正在同步的副本, 同一个副本不并发同步. true 表示同步期间又有修改, 结束后要再来一次
+	statusHub *StatusHub
+}
+
+func NewReplicatedStorage() *ReplicatedStorage {
+	return &ReplicatedStorage{}
+}
+
+func (r *ReplicatedStorage) Init(cfg model.StorageConfig) error {
+	r.cfg = cfg.Replicated
+	if r.cfg.SyncWorkers == 0 {
+		r.cfg.SyncWorkers = 1
+	}
+	if r.cfg.RetryInterval == 0 {
+		r.cfg.RetryInterval = 60
+	}
+
+	replicaTypes := splitStorageTypes(r.cfg.Replicas)
+	if len(replicaTypes) == 0 {
+		return fmt.Errorf("Replicated.Replicas is empty")
+	}
+	primaryType := model.StorageType(strings.TrimSpace(r.cfg.Primary))
+	all := append([]model.StorageType{primaryType}, replicaTypes...)
+	for i, storageType := range all {
+		if storageType == StorageTypeReplicatedStorage {
+			return fmt.Errorf("%s can not be nested", StorageTypeReplicatedStorage)
+		}
+		if slices.Contains(all[:i], storageType) {
+			return fmt.Errorf("storage type %q is configured more than once", storageType)
+		}
+	}
+	readTypes := splitStorageTypes(r.cfg.ReadOrder)
+	if len(readTypes) == 0 {
+		readTypes = all
+	}
+	for _, storageType := range readTypes {
+		if !slices.Contains(all, storageType) {
+			return fmt.Errorf("ReadOrder %q is neither primary nor replica", storageType)
+		}
+	}
+
+	var started []Interface
+	closeStarted := func() {
+		for _, backend := range started {
+			backend.Close()
+		}
+	}
+	backends := make(map[model.StorageType]replicaBackend)
+	for i, storageType := range all {
+		backend, err := New(storageType)
+		if err != nil {
+			closeStarted()
+			return err
+		}
+		subCfg := cfg
+		if i > 0 {
+			subCfg.DB.URL = replicaDBURL(cfg.DB.URL, storageType)
+		}
+		if err := backend.Init(subCfg); err != nil {
+			closeStarted()
+			return fmt.Errorf("init %s failed : %w", storageType, err)
+		}
+		started = append(started, backend)
+		backends[storageType] = replicaBackend{storageType: storageType, storage: backend}
+	}
+	r.primary = backends[primaryType]
+	for _, storageType := range replicaTypes {
+		r.replicas = append(r.replicas, backends[storageType])
+	}
+	for _, storageType := range readTypes {
+		r.readOrder = append(r.readOrder, backends[storageType])
+	}
+
+	holder, ok := r.primary.storage.(metaDBHolder)
+	if !ok {
+		closeStarted()
+		return fmt.Errorf("%s can not be used as primary", r.cfg.Primary)
+	}
+	r.DB = holder.metaDB()
+	if err := r.DB.MigrateReplicas(); err != nil {
+		closeStarted()
+		return err
+	}
+	for _, replica := range r.replicas {
+		added, err := r.DB.BackfillReplicas(context.Background(), replica.storageType)
+		if err != nil {
+			closeStarted()
+			return err
+		}
+		if added > 0 {
+			log.Printf("%d maps are waiting to be replicated to %s", added, replica.storageType)
+		}
+	}
+
+	r.ctx, r.ctxCancel = context.WithCancel(context.Background())
+	r.jobs = make(chan replicaJob, replicaScanLimit)
+	r.running = make(map[replicaJob]bool)
+	r.statusHub = NewStatusHub()
+	r.wg.Add(int(r.cfg.SyncWorkers) + 1)
+	for range r.cfg.SyncWorkers {
+		go func() {
+			defer r.wg.Done()
+			r.syncWorker()
+		}()
+	}
+	go func() {
+		defer r.wg.Done()
+		r.retryService()
+	}()
+	return nil
+}
+
+func splitStorageTypes(value string) []model.StorageType {
+	var result []model.StorageType
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, model.StorageType(item))
+		}
+	}
+	return result
+}
+
+// data.db -> data.GitStorage.db
+func replicaDBURL(url string, storageType model.StorageType) string {
+	ext := filepath.Ext(url)
+	return strings.TrimSuffix(url, ext) + "." + string(storageType) + ext
+}
+
+func (r *ReplicatedStorage) metaDB() *StorageDB {
+	return r.DB
+}
+
+func (r *ReplicatedStorage) Close() error {
+	r.ctxCancel()
+	r.wg.Wait()
+	var errs []error
+	for _, backend := range append([]replicaBackend{r.primary}, r.replicas...) {
+		errs = append(errs, backend.storage.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// 主存储写成功才算成功, 副本记为 pending 后异步复制
+func (r *ReplicatedStorage) Save(ctx context.Context, metaData model.MapMetaData, reader io.Reader) (*model.MapMetaData, error) {
+	saved, err := r.primary.storage.Save(ctx, metaData, reader)
+	if err != nil {
+		return saved, err
+	}
+	r.markReplicasPending(ctx, saved.Hash)
+	return saved, nil
+}
+
+// 主存储支持批量提交时用主存储的批次, 副本照样逐个异步复制
+func (r *ReplicatedStorage) NewBatch() SaveBatch {
+	batch := &replicatedSaveBatch{storage: r}
+	if saver, ok := r.primary.storage.(BatchSaver); ok {
+		batch.primary = saver.NewBatch()
+	}
+	return batch
+}
+
+type replicatedSaveBatch struct {
+	storage *ReplicatedStorage
+	primary SaveBatch
+	hashes  []string
+}
+
+func (b *replicatedSaveBatch) Save(ctx context.Context, metaData model.MapMetaData, reader io.Reader) (*model.MapMetaData, error) {
+	if b.primary == nil {
+		return b.storage.Save(ctx, metaData, reader)
+	}
+	saved, err := b.primary.Save(ctx, metaData, reader)
+	if err == nil {
+		b.hashes = append(b.hashes, saved.Hash)
+	}
+	return saved, err
+}
+
+func (b *replicatedSaveBatch) Commit() {
+	if b.primary == nil {
+		return
+	}
+	b.primary.Commit()
+	for _, hash := range b.hashes {
+		b.storage.markReplicasPending(b.storage.ctx, hash)
+	}
+}
+
+// 按 ReadOrder 依次读, 已经往 writer 写了内容之后就不能再换下一个了
+func (r *ReplicatedStorage) Get(ctx context.Context, hash string, writer io.Writer) (*model.MapMetaData, error) {
+	var firstErr error
+	for _, backend := range r.readOrder {
+		counter := &countingWriter{writer: writer}
+		metaData, err := backend.storage.Get(ctx, hash, counter)
+		if err == nil {
+			return metaData, nil
+		}
+		if counter.n > 0 || ctx.Err() != nil {
+			return nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if !errors.Is(err, ErrMapNotFound) {
+			log.Printf("read %s from %s failed, try next : %v", hash, backend.storageType, err)
+		}
+	}
+	return nil, firstErr
+}
+
+func (r *ReplicatedStorage) GetPreview(ctx context.Context, hash string, writer io.Writer) error {
+	var firstErr error
+	for _, backend := range r.readOrder {
+		counter := &countingWriter{writer: writer}
+		err := backend.storage.GetPreview(ctx, hash, counter)
+		if err == nil {
+			return nil
+		}
+		if counter.n > 0 || ctx.Err() != nil {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (r *ReplicatedStorage) GetMeta(ctx context.Context, hash string) (*model.MapMetaData, error) {
+	return r.primary.storage.GetMeta(ctx, hash)
+}
+
+func (r *ReplicatedStorage) Update(ctx context.Context, hash string, update model.MapMetaDataUpdate) (*model.MapMetaData, error) {
+	metaData, err := r.primary.storage.Update(ctx, hash, update)
+	if err != nil {
+		return nil, err
+	}
+	r.markReplicasPending(ctx, hash)
+	return metaData, nil
+}
+
+func (r *ReplicatedStorage) GetHistory(ctx context.Context, hash string, limit int) (*model.MapHistory, error) {
+	return r.primary.storage.GetHistory(ctx, hash, limit)
+}
+
+func (r *ReplicatedStorage) Exists(ctx context.Context, hash string) (bool, error) {
+	return r.primary.storage.Exists(ctx, hash)
+}
+
+func (r *ReplicatedStorage) SearchExact(ctx context.Context, name string, limit int) ([]model.MapMetaData, error) {
+	return r.primary.storage.SearchExact(ctx, name, limit)
+}
+
+func (r *ReplicatedStorage) Search(ctx context.Context, name string, limit int) ([]model.MapMetaData, error) {
+	return r.primary.storage.Search(ctx, name, limit)
+}
+
+func (r *ReplicatedStorage) SearchMeta(ctx context.Context, search model.MapMetaDataSearch) ([]model.MapMetaData, error) {
+	return r.primary.storage.SearchMeta(ctx, search)
+}
+
+func (r *ReplicatedStorage) List(ctx context.Context, page int, desc bool, orderField string, limit int) ([]model.MapMetaData, error) {
+	return r.primary.storage.List(ctx, page, desc, orderField, limit)
+}
+
+// 副本上的删除由同步任务发现主存储里没有了之后执行
+func (r *ReplicatedStorage) Delete(ctx context.Context, hash string) error {
+	if err := r.primary.storage.Delete(ctx, hash); err != nil {
+		return err
+	}
+	r.markReplicasPending(ctx, hash)
+	return nil
+}
+
+// 进度以主存储为准, 主存储不是异步存储时不会有事件
+func (r *ReplicatedStorage) SubscribeStatus(hash string) (<-chan model.MapStatusEvent, func()) {
+	if notifier, ok := r.primary.storage.(StatusNotifier); ok {
+		return notifier.SubscribeStatus(hash)
+	}
+	return r.statusHub.Subscribe(hash)
+}
+
+func (r *ReplicatedStorage) LatestStatus(hash string) (model.MapStatusEvent, bool) {
+	if notifier, ok := r.primary.storage.(StatusNotifier); ok {
+		return notifier.LatestStatus(hash)
+	}
+	return model.MapStatusEvent{}, false
+}
+
+// 各个副本的同步状态, 主存储已经删掉并且副本也删完的地图返回空列表
+func (r *ReplicatedStorage) ReplicaStatus(ctx context.Context, hash string) ([]model.MapReplica, error) {
+	return r.DB.Replicas(ctx, hash)
+}
+
+func (r *ReplicatedStorage) markReplicasPending(ctx context.Context, hash string) {
+	for _, replica := range r.replicas {
+		if err := r.DB.SetReplicaStatus(ctx, hash, replica.storageType, model.ReplicaStatusPending, ""); err != nil {
+			log.Printf("mark %s on %s pending failed : %v", hash, replica.storageType, err)
+			continue
+		}
+		r.enqueue(replicaJob{hash: hash, backend: replica.storageType})
+	}
+}
+
+// 正在同步的只做标记, 由正在同步的 worker 结束后再同步一次. 队列满了就等定时重试
+func (r *ReplicatedStorage) enqueue(job replicaJob) {
+	if r.markDirty(job) {
+		return
+	}
+	select {
+	case r.jobs <- job:
+	default:
+	}
+}
+
+// 正在同步时标记需要重来, 返回是否正在同步
+func (r *ReplicatedStorage) markDirty(job replicaJob) bool {
+	r.runningMu.Lock()
+	defer r.runningMu.Unlock()
+	if _, busy := r.running[job]; busy {
+		r.running[job] = true
+		return true
+	}
+	return false
+}
+
+// 开始同步, 已经有 worker 在同步时标记需要重来并返回 false
+func (r *ReplicatedStorage) startJob(job replicaJob) bool {
+	r.runningMu.Lock()
+	defer r.runningMu.Unlock()
+	if _, busy := r.running[job]; busy {
+		r.running[job] = true
+		return false
+	}
+	r.running[job] = false
+	return true
+}
+
+// 同步期间被标记过就返回 true, 调用方要再同步一次; 否则结束
+func (r *ReplicatedStorage) finishJob(job replicaJob) bool {
+	r.runningMu.Lock()
+	defer r.runningMu.Unlock()
+	if r.running[job] {
+		r.running[job] = false
+		return true
+	}
+	delete(r.running, job)
+	return false
+}
+
+func (r *ReplicatedStorage) syncWorker() {
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case job := <-r.jobs:
+			if !r.startJob(job) {
+				continue
+			}
+			// 同步时写的状态可能盖掉了期间 Update/Delete 写的 pending, 再同步一次
+			for {
+				r.syncReplica(job)
+				if r.ctx.Err() != nil || !r.finishJob(job) {
+					break
+				}
+			}
+		}
+	}
+}
+
+// 启动时和之后每隔 RetryInterval 把没同步好的副本重新放进队列
+func (r *ReplicatedStorage) retryService() {
+	ticker := time.NewTicker(time.Duration(r.cfg.RetryInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		replicas, err := r.DB.UnsyncedReplicas(r.ctx, r.cfg.MaxAttempts, replicaScanLimit)
+		if err != nil && r.ctx.Err() == nil {
+			log.Printf("scan unsynced replicas failed : %v", err)
+		}
+		for _, replica := range replicas {
+			r.enqueue(replicaJob{hash: replica.Hash, backend: replica.Backend})
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *ReplicatedStorage) replica(storageType model.StorageType) (replicaBackend, bool) {
+	for _, replica := range r.replicas {
+		if replica.storageType == storageType {
+			return replica, true
+		}
+	}
+	return replicaBackend{}, false
+}
+
+// 让副本和主存储一致: 主存储没有了就删副本, 副本没有就复制, 元数据不一样就改
+func (r *ReplicatedStorage) syncReplica(job replicaJob) {
+	ctx := r.ctx
+	replica, ok := r.replica(job.backend)
+	if !ok {
+		// 配置里去掉了的副本
+		r.DB.DeleteReplica(ctx, job.hash, job.backend)
+		return
+	}
+	status, msg := r.reconcile(ctx, job.hash, replica)
+	if ctx.Err() != nil {
+		return
+	}
+	var err error
+	if status == "" {
+		err = r.DB.DeleteReplica(ctx, job.hash, job.backend)
+	} else {
+		if status == model.ReplicaStatusFailed {
+			log.Printf("replicate %s to %s failed : %s", job.hash, job.backend, msg)
+		}
+		err = r.DB.SetReplicaStatus(ctx, job.hash, job.backend, status, msg)
+	}
+	if err != nil {
+		log.Printf("record replica status of %s on %s failed : %v", job.hash, job.backend, err)
+	}
+}
+
+// 返回空状态表示地图已经从主存储和副本删干净了
+func (r *ReplicatedStorage) reconcile(ctx context.Context, hash string, replica replicaBackend) (model.ReplicaStatus, string) {
+	primaryMeta, err := r.primary.storage.GetMeta(ctx, hash)
+	deleted := errors.Is(err, ErrMapNotFound)
+	if err != nil && !deleted {
+		return model.ReplicaStatusFailed, fmt.Sprintf("read primary meta : %v", err)
+	}
+	if !deleted {
+		switch primaryMeta.StorageStatus {
+		case model.MapUploadStatusOnProgress:
+			return model.ReplicaStatusPending, "waiting for primary"
+		case model.MapUploadStatusFailed:
+			return model.ReplicaStatusFailed, "primary failed : " + primaryMeta.StorageStatusMsg
+		case model.MapDeleteStatusOnProgress, model.MapDeleteStatusFailed:
+			deleted = true
+		}
+	}
+
+	replicaMeta, err := replica.storage.GetMeta(ctx, hash)
+	replicaMissing := errors.Is(err, ErrMapNotFound)
+	if err != nil && !replicaMissing {
+		return model.ReplicaStatusFailed, fmt.Sprintf("read replica meta : %v", err)
+	}
+
+	if deleted {
+		if replicaMissing {
+			return "", ""
+		}
+		if replicaMeta.StorageStatus == model.MapDeleteStatusOnProgress {
+			return model.ReplicaStatusPending, "replica delete on progress"
+		}
+		if err := replica.storage.Delete(ctx, hash); err != nil && !errors.Is(err, ErrMapNotFound) {
+			return model.ReplicaStatusFailed, fmt.Sprintf("delete replica : %v", err)
+		}
+		// 异步存储的删除要下一轮确认
+		return model.ReplicaStatusPending, "replica delete on progress"
+	}
+
+	if replicaMissing {
+		replicaMeta, err = r.copyToReplica(ctx, *primaryMeta, replica)
+		if err != nil {
+			return model.ReplicaStatusFailed, fmt.Sprintf("copy to replica : %v", err)
+		}
+	}
+	switch replicaMeta.StorageStatus {
+	case model.MapUploadStatusOnProgress, model.MapDeleteStatusOnProgress:
+		return model.ReplicaStatusPending, "replica on progress"
+	case model.MapUploadStatusFailed, model.MapDeleteStatusFailed:
+		// 删掉失败的副本, 下次重试重新复制
+		if err := replica.storage.Delete(ctx, hash); err != nil {
+			log.Printf("remove failed replica %s on %s : %v", hash, replica.storageType, err)
+		}
+		return model.ReplicaStatusFailed, "replica failed : " + replicaMeta.StorageStatusMsg
+	}
+
+	if update, changed := metaDiff(*primaryMeta, *replicaMeta); changed {
+		if _, err := replica.storage.Update(ctx, hash, update); err != nil {
+			return model.ReplicaStatusFailed, fmt.Sprintf("update replica meta : %v", err)
+		}
+	}
+	return model.ReplicaStatusSynced, ""
+}
+
+// 从主存储取出文件存到副本, 副本上已经有了也算成功
+func (r *ReplicatedStorage) copyToReplica(ctx context.Context, metaData model.MapMetaData, replica replicaBackend) (*model.MapMetaData, error) {
+	if err := os.MkdirAll(replicaSpoolDir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(replicaSpoolDir, "replica_*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := r.primary.storage.Get(ctx, metaData.Hash, file); err != nil {
+		return nil, fmt.Errorf("read from primary : %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	saved, err := replica.storage.Save(ctx, metaData, file)
+	if errors.Is(err, ErrMapExists) {
+		return saved, nil
+	}
+	return saved, err
+}
+
+// 用户可以改的字段里和主存储不一样的部分
+func metaDiff(primary model.MapMetaData, replica model.MapMetaData) (model.MapMetaDataUpdate, bool) {
+	var update model.MapMetaDataUpdate
+	changed := false
+	if primary.Name != replica.Name {
+		update.Name = &primary.Name
+		changed = true
+	}
+	if primary.Message != replica.Message {
+		update.Message = &primary.Message
+		changed = true
+	}
+	if primary.Authors != replica.Authors {
+		update.Authors = &primary.Authors
+		changed = true
+	}
+	if primary.PrevHash != replica.PrevHash {
+		update.PrevHash = &primary.PrevHash
+		changed = true
+	}
+	return update, changed
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"testing"
+)
+
+// 同步期间又入队的任务不能丢, 要在当前这轮结束后再同步一次
+func TestReplicatedJobRerunWhenDirty(t *testing.T) {
+	r := &ReplicatedStorage{jobs: make(chan replicaJob, 1), running: make(map[replicaJob]bool)}
+	job := replicaJob{hash: "abc", backend: StorageTypeGitStorage}
+
+	if !r.startJob(job) {
+		t.Fatal("first start should run")
+	}
+	r.enqueue(job)
+	if len(r.jobs) != 0 {
+		t.Error("running job should be marked instead of queued")
+	}
+	if r.startJob(job) {
+		t.Error("job already running")
+	}
+	if !r.finishJob(job) {
+		t.Fatal("dirty job should run again")
+	}
+	if r.finishJob(job) {
+		t.Error("clean job should finish")
+	}
+	if _, ok := r.running[job]; ok {
+		t.Error("finished job still marked running")
+	}
+
+	r.enqueue(job)
+	if len(r.jobs) != 1 {
+		t.Error("idle job should be queued")
+	}
+}
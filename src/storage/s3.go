@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	mapConfig "map-storage-cnb/src/config"
+	"map-storage-cnb/src/model"
+)
+
+const (
+	StorageTypeS3Storage model.StorageType = "S3Storage"
+
+	// S3 要求除最后一片以外每片至少5MB
+	s3MinPartSize        = 5 << 20
+	s3MapContentType     = "application/octet-stream"
+	s3PreviewContentType = "image/png"
+)
+
+// 上传前先落盘算哈希, 签名要用到
+var s3SpoolDir = filepath.Join(mapConfig.UploadTmpDir, "s3_spool")
+
+// 地图和预览图放在兼容S3的对象存储里, 元数据和其它存储一样放在db
+type S3Storage struct {
+	cfg    model.S3StorageConfig
+	client *s3Client
+	DB     *StorageDB
+}
+
+func NewS3Storage() *S3Storage {
+	return &S3Storage{}
+}
+
+func (s *S3Storage) Init(cfg model.StorageConfig) error {
+	s.cfg = cfg.S3Storage
+	if s.cfg.PartSize < s3MinPartSize {
+		s.cfg.PartSize = s3MinPartSize
+	}
+	client, err := newS3Client(s.cfg)
+	if err != nil {
+		return err
+	}
+	s.client = client
+
+	ctx := context.Background()
+	if err := client.HeadBucket(ctx); err != nil {
+		if !isS3NotFound(err) || !s.cfg.CreateBucket {
+			return fmt.Errorf("check s3 bucket %q failed : %w", s.cfg.Bucket, err)
+		}
+		log.Printf("s3 bucket %q not found, creating", s.cfg.Bucket)
+		if err := client.CreateBucket(ctx); err != nil {
+			return fmt.Errorf("create s3 bucket %q failed : %w", s.cfg.Bucket, err)
+		}
+	}
+
+	db, err := DBInit(cfg)
+	if err != nil {
+		return err
+	}
+	s.DB = db
+	return nil
+}
+
+func (s *S3Storage) metaDB() *StorageDB {
+	return s.DB
+}
+
+func (s *S3Storage) Close() error {
+	return s.DB.Close()
+}
+
+func (s *S3Storage) mapKey(hash string) string {
+	return s.cfg.Prefix + hash
+}
+
+func (s *S3Storage) previewKey(hash string) string {
+	return s.cfg.Prefix + previewFileName(hash)
+}
+
+func (s *S3Storage) Save(ctx context.Context, metaData model.MapMetaData, reader io.Reader) (*model.MapMetaData, error) {
+	spooled, err := SpoolToTemp(s3SpoolDir, reader)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Path)
+
+	existing, err := acceptSpooled(ctx, s.DB, &metaData, spooled)
+	if err != nil {
+		return existing, err
+	}
+
+	metaData.SetStorageType(StorageTypeS3Storage)
+	if err := s.uploadFile(ctx, s.mapKey(metaData.Hash), spooled.Path, spooled.Hash, s3MapContentType); err != nil {
+		return nil, err
+	}
+	if preview := spoolPreview(s3SpoolDir, spooled.Path); preview != "" {
+		hash, err := hashFile(preview)
+		if err == nil {
+			err = s.uploadFile(ctx, s.previewKey(metaData.Hash), preview, hash, s3PreviewContentType)
+		}
+		if err != nil {
+			log.Printf("save preview of %s failed : %v", metaData.Hash, err)
+		}
+		os.Remove(preview)
+	}
+	metaData.SetStorageStatus(model.MapUploadStatusSuccess, "")
+	if err := s.DB.Add(ctx, metaData); err != nil {
+		return nil, err
+	}
+	return &metaData, nil
+}
+
+// 小文件直接 PUT, 超过 PartSize 分片上传
+func (s *S3Storage) uploadFile(ctx context.Context, key string, path string, hash string, contentType string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= s.cfg.PartSize {
+		return s.client.PutObject(ctx, key, file, info.Size(), hash, contentType)
+	}
+	return s.uploadMultipart(ctx, key, file, contentType)
+}
+
+// 失败时取消分片上传, 不然已经传上去的分片会一直占着空间
+func (s *S3Storage) uploadMultipart(ctx context.Context, key string, reader io.Reader, contentType string) error {
+	uploadID, err := s.client.CreateMultipartUpload(ctx, key, contentType)
+	if err != nil {
+		return err
+	}
+
+	var parts []s3CompletedPart
+	buf := make([]byte, s.cfg.PartSize)
+	for partNumber := 1; ; partNumber++ {
+		n, readErr := io.ReadFull(reader, buf)
+		if n > 0 {
+			part, err := s.client.UploadPart(ctx, key, uploadID, partNumber, buf[:n])
+			if err != nil {
+				s.abortMultipart(key, uploadID)
+				return fmt.Errorf("upload part %d of %s failed : %w", partNumber, key, err)
+			}
+			parts = append(parts, part)
+		}
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if readErr != nil {
+			s.abortMultipart(key, uploadID)
+			return readErr
+		}
+	}
+
+	if err := s.client.CompleteMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		s.abortMultipart(key, uploadID)
+		return fmt.Errorf("complete multipart upload of %s failed : %w", key, err)
+	}
+	return nil
+}
+
+// 请求可能已经被取消了, 用新的context
+func (s *S3Storage) abortMultipart(key string, uploadID string) {
+	if err := s.client.AbortMultipartUpload(context.Background(), key, uploadID); err != nil {
+		log.Printf("abort multipart upload %s of %s failed : %v", uploadID, key, err)
+	}
+}
+
+func (s *S3Storage) Get(ctx context.Context, hash string, writer io.Writer) (*model.MapMetaData, error) {
+	metaData, err := s.DB.Get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	body, err := s.client.GetObject(ctx, s.mapKey(hash))
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, fmt.Errorf("%w : %s object missing", ErrMapNotFound, hash)
+		}
+		return nil, err
+	}
+	defer body.Close()
+
+	if _, err := io.Copy(writer, body); err != nil {
+		return nil, err
+	}
+	return metaData, nil
+}
+
+func (s *S3Storage) GetPreview(ctx context.Context, hash string, writer io.Writer) error {
+	if _, err := s.DB.Get(ctx, hash); err != nil {
+		return err
+	}
+	body, err := s.client.GetObject(ctx, s.previewKey(hash))
+	if err != nil {
+		if isS3NotFound(err) {
+			return fmt.Errorf("%w : %s", ErrPreviewNotFound, hash)
+		}
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(writer, body)
+	return err
+}
+
+func (s *S3Storage) GetMeta(ctx context.Context, hash string) (*model.MapMetaData, error) {
+	return s.DB.Get(ctx, hash)
+}
+
+func (s *S3Storage) Update(ctx context.Context, hash string, update model.MapMetaDataUpdate) (*model.MapMetaData, error) {
+	if err := s.DB.UpdateFields(ctx, hash, update); err != nil {
+		return nil, err
+	}
+	return s.DB.Get(ctx, hash)
+}
+
+func (s *S3Storage) GetHistory(ctx context.Context, hash string, limit int) (*model.MapHistory, error) {
+	return s.DB.History(ctx, hash, limit)
+}
+
+func (s *S3Storage) Exists(ctx context.Context, hash string) (bool, error) {
+	_, err := s.DB.Get(ctx, hash)
+	if err != nil {
+		if errors.Is(err, ErrMapNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *S3Storage) SearchExact(ctx context.Context, name string, limit int) ([]model.MapMetaData, error) {
+	return s.DB.SearchExact(ctx, name, limit)
+}
+
+func (s *S3Storage) Search(ctx context.Context, name string, limit int) ([]model.MapMetaData, error) {
+	return s.DB.Search(ctx, name, limit)
+}
+
+func (s *S3Storage) SearchMeta(ctx context.Context, search model.MapMetaDataSearch) ([]model.MapMetaData, error) {
+	return s.DB.SearchMeta(ctx, search)
+}
+
+func (s *S3Storage) List(ctx context.Context, page int, desc bool, orderField string, limit int) ([]model.MapMetaData, error) {
+	return s.DB.List(ctx, page, desc, orderField, limit)
+}
+
+func (s *S3Storage) Delete(ctx context.Context, hash string) error {
+	if _, err := s.DB.Get(ctx, hash); err != nil {
+		return err
+	}
+	for _, key := range []string{s.mapKey(hash), s.previewKey(hash)} {
+		if err := s.client.DeleteObject(ctx, key); err != nil {
+			return err
+		}
+	}
+	return s.DB.Delete(ctx, hash)
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"map-storage-cnb/src/model"
+	"map-storage-cnb/src/utils"
+)
+
+// 落盘到临时文件的上传内容
+type SpooledFile struct {
+	Path string
+	Hash string
+	Size uint64
+}
+
+// 把 reader 读到 dir 下的临时文件直到 EOF, 边写边算sha256.
+// 临时文件和最终位置放在同一个目录, 之后 rename 就是原子的
+func SpoolToTemp(dir string, reader io.Reader) (*SpooledFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), reader)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &SpooledFile{
+		Path: tmp.Name(),
+		Hash: hex.EncodeToString(hasher.Sum(nil)),
+		Size: uint64(size),
+	}, nil
+}
+
+// 落盘之后的公共校验: 比对客户端给的哈希, 再按哈希和规范化哈希查重.
+// 通过后把算出来的哈希和大小写回 metaData, 重复时返回已有的 Meta 和 ErrMapExists (规范化哈希重复是 ErrMapDuplicate)
+func acceptSpooled(ctx context.Context, db *StorageDB, metaData *model.MapMetaData, spooled *SpooledFile) (*model.MapMetaData, error) {
+	if metaData.Hash != "" && !strings.EqualFold(metaData.Hash, spooled.Hash) {
+		return nil, fmt.Errorf("%w : expect %s but got %s", ErrHashMismatch, metaData.Hash, spooled.Hash)
+	}
+	existing, err := db.Get(ctx, spooled.Hash)
+	if err == nil {
+		return existing, fmt.Errorf("%w : %s", ErrMapExists, spooled.Hash)
+	}
+	if !errors.Is(err, ErrMapNotFound) {
+		return nil, err
+	}
+	if metaData.CanonicalHash != "" {
+		original, err := db.GetByCanonicalHash(ctx, metaData.CanonicalHash)
+		if err == nil {
+			return original, fmt.Errorf("%w : %s is the same map as %s", ErrMapDuplicate, spooled.Hash, original.Hash)
+		}
+		if !errors.Is(err, ErrMapNotFound) {
+			return nil, err
+		}
+	}
+	metaData.Hash = spooled.Hash
+	metaData.Size = spooled.Size
+	return nil, nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return utils.HashReader(file)
+}
+
+// rename 失败(例如跨文件系统)时退回 copy + remove
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"sync"
+
+	"map-storage-cnb/src/model"
+)
+
+const statusSubscriberBuffer = 16
+
+type statusSubscriber struct {
+	hash   string // 空字符串表示订阅全部
+	events chan model.MapStatusEvent
+}
+
+// 存储状态事件的广播, 同时记住还没结束的地图最近一次的状态
+type StatusHub struct {
+	mu          sync.Mutex
+	subscribers map[*statusSubscriber]struct{}
+	latest      map[string]model.MapStatusEvent
+}
+
+func NewStatusHub() *StatusHub {
+	return &StatusHub{
+		subscribers: make(map[*statusSubscriber]struct{}),
+		latest:      make(map[string]model.MapStatusEvent),
+	}
+}
+
+// 订阅 hash 的状态变化, 返回的函数用来取消订阅
+func (h *StatusHub) Subscribe(hash string) (<-chan model.MapStatusEvent, func()) {
+	sub := &statusSubscriber{hash: hash, events: make(chan model.MapStatusEvent, statusSubscriberBuffer)}
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub.events, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(sub)
+	}
+}
+
+// 调用方需要持有 mu, 订阅可能已经被 Publish 关掉了
+func (h *StatusHub) remove(sub *statusSubscriber) {
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// 不会阻塞推送方, 订阅者缓冲满了就丢掉中间状态的事件.
+// 最终状态不能丢, 塞不进去就关掉这个订阅, 订阅者看到 channel 关闭后自己去查当前状态
+func (h *StatusHub) Publish(event model.MapStatusEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if event.Stage.IsFinal() {
+		delete(h.latest, event.Hash)
+	} else {
+		h.latest[event.Hash] = event
+	}
+	for sub := range h.subscribers {
+		if sub.hash != "" && sub.hash != event.Hash {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			if event.Stage.IsFinal() {
+				h.remove(sub)
+			}
+		}
+	}
+}
+
+// 还在处理中的地图最近一次的状态
+func (h *StatusHub) Latest(hash string) (model.MapStatusEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	event, ok := h.latest[hash]
+	return event, ok
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/hex"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,10 +16,6 @@ func InitDefaultDir() {
 	if err != nil {
 		panic(err)
 	}
-	err = os.MkdirAll("./uploads", 0755)
-	if err != nil {
-		panic(err)
-	}
 }
 
 // Hash bytes in sha256
@@ -27,6 +24,15 @@ func HashFile(data []byte) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// Hash reader content in sha256, read until EOF
+func HashReader(reader io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 // "2006/01/02"
 func TimeNowDay() string {
 	return time.Now().Format("2006/01/02")